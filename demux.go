@@ -0,0 +1,176 @@
+package ogg
+
+import "io"
+
+// A Bitstream describes a logical bitstream found by a Demuxer.
+type Bitstream struct {
+  Serial uint32
+
+  // The magic string of the registered format that the bitstream belongs
+  // to, or "" if it doesn't match any of them.
+  Format string
+
+  // The packet on the first page of the bitstream, which for most formats
+  // is enough to tell what it holds.
+  First []byte
+}
+
+// describeBitstream returns the Bitstream that page is the first page of.
+// First is as much of the first packet as is on the page.
+func describeBitstream(page Page) Bitstream {
+  size := 0
+  for _, seg_len := range page.Segment_table {
+    size += int(seg_len)
+    if seg_len < 255 {
+      break
+    }
+  }
+  bitstream := Bitstream{Serial: page.Bitstream_serial_number, First: page.Data[0:size]}
+  bitstream.Format, _ = detectFormat(bitstream.First)
+  return bitstream
+}
+
+// A Demuxer reads a file holding several logical bitstreams, such as audio
+// and video or a number of audio tracks, and returns the packets of the
+// ones the caller is interested in.  Each bitstream is offered to a choose
+// function when its first page is read, and only the packets of those it
+// picks are returned.  Bitstreams can also be picked or dropped later on with
+// Select.
+type Demuxer struct {
+  pages  *PageReader
+  choose func(stream Bitstream) bool
+
+  // The bitstreams that have started but not ended, keyed by serial number
+  streams map[uint32]*demuxStream
+
+  // Every bitstream seen so far, in the order they started
+  bitstreams []Bitstream
+
+  // Packets that have been completed but not returned yet, in the order
+  // they were completed
+  ready []demuxPacket
+}
+
+type demuxStream struct {
+  packets  *PacketReader
+  selected bool
+}
+
+type demuxPacket struct {
+  serial uint32
+  packet Packet
+}
+
+// NewDemuxer returns a Demuxer that reads from in.  choose is called with
+// each new bitstream and returns true if its packets should be returned, if
+// it is nil every bitstream is picked.
+func NewDemuxer(in io.Reader, options Options, choose func(stream Bitstream) bool) *Demuxer {
+  return &Demuxer{
+    pages:   NewPageReader(in, options),
+    choose:  choose,
+    streams: make(map[uint32]*demuxStream),
+  }
+}
+
+// Bitstreams returns every bitstream that has been found so far
+func (d *Demuxer) Bitstreams() []Bitstream {
+  return d.bitstreams
+}
+
+// Select picks or drops a bitstream that has already started.  A dropped
+// bitstream's packets that have already been read are thrown away, and if it
+// is picked again any packet it was part way through is lost.
+func (d *Demuxer) Select(serial uint32, selected bool) {
+  stream, ok := d.streams[serial]
+  if !ok || stream.selected == selected {
+    return
+  }
+  stream.selected = selected
+  if selected {
+    // The next page continues a packet whose start was never read
+    stream.packets.skipping = true
+    return
+  }
+  stream.packets.packets = nil
+  stream.packets.partial = nil
+  ready := d.ready[0:0]
+  for _, p := range d.ready {
+    if p.serial != serial {
+      ready = append(ready, p)
+    }
+  }
+  d.ready = ready
+}
+
+// ReadPacket returns the next packet of any of the picked bitstreams, along
+// with the serial number of its bitstream.  Packets are returned in the
+// order they are completed in the file.  At the end of the input it returns
+// io.EOF, or an *UnfinishedError if any bitstream hadn't ended.  Packets
+// over Max_packet_size are dropped just as PacketReader drops them.
+func (d *Demuxer) ReadPacket() (uint32, Packet, error) {
+  for len(d.ready) == 0 {
+    page, err := d.pages.ReadPage()
+    if err == io.EOF {
+      if len(d.streams) > 0 {
+        unfinished := &UnfinishedError{Offset: d.pages.offset}
+        for _, stream := range d.bitstreams {
+          if _, ok := d.streams[stream.Serial]; ok {
+            unfinished.Serials = append(unfinished.Serials, stream.Serial)
+          }
+        }
+        return 0, Packet{}, unfinished
+      }
+      return 0, Packet{}, io.EOF
+    }
+    if err != nil {
+      return 0, Packet{}, err
+    }
+    if err := d.readPage(page); err != nil {
+      return 0, Packet{}, err
+    }
+  }
+  p := d.ready[0]
+  d.ready = d.ready[1:]
+  return p.serial, p.packet, nil
+}
+
+// readPage adds the packets completed on a page to the ready queue,
+// starting a new bitstream if it is the first page of one.  The packets are
+// queued even if one of them was too large and an error is returned.
+func (d *Demuxer) readPage(page Page) error {
+  var err error
+  serial := page.Bitstream_serial_number
+  stream, ok := d.streams[serial]
+  if page.Header_type&0x2 != 0 && !ok {
+    stream = &demuxStream{packets: newBitstreamReader(serial, d.pages.options.Limits)}
+    d.streams[serial] = stream
+    err = stream.packets.readPage(page, d.pages.Offset())
+    bitstream := Bitstream{Serial: serial}
+    if len(stream.packets.packets) > 0 {
+      bitstream.First = stream.packets.packets[0].Data
+    }
+    bitstream.Format, _ = detectFormat(bitstream.First)
+    d.bitstreams = append(d.bitstreams, bitstream)
+    stream.selected = d.choose == nil || d.choose(bitstream)
+  } else if ok {
+    if stream.selected {
+      err = stream.packets.readPage(page, d.pages.Offset())
+    } else {
+      stream.packets.next_sequence = page.Page_sequence_number + 1
+    }
+  } else {
+    // A page from a bitstream whose start we never saw
+    return nil
+  }
+
+  if stream.selected {
+    for _, packet := range stream.packets.packets {
+      d.ready = append(d.ready, demuxPacket{serial, packet})
+    }
+  }
+  stream.packets.packets = nil
+  if page.Header_type&0x4 != 0 {
+    delete(d.streams, serial)
+  }
+  return err
+}
@@ -0,0 +1,98 @@
+package ogg
+
+import (
+  "errors"
+  "fmt"
+  "io"
+)
+
+// The kinds of problem that can be found in an Ogg file.  Errors returned by
+// this package match one of these with errors.Is, and carry the offset of the
+// problem in the input.  Use errors.As with *PageError, *CRCError or
+// *UnfinishedError to get the details.
+var (
+  ErrCapturePattern    = errors.New("Page doesn't start with OggS")
+  ErrVersion           = errors.New("Unsupported page version")
+  ErrCRC               = errors.New("CRC failed")
+  ErrTruncatedPage     = errors.New("Input ended part way through a page")
+  ErrDuplicateBOS      = errors.New("Bitstream started twice")
+  ErrMissingBOS        = errors.New("Page from a bitstream that never started")
+  ErrUnfinishedStreams = errors.New("Input ended before every bitstream did")
+  ErrLimitExceeded     = errors.New("Limit exceeded")
+)
+
+// A PageError is a problem with a single page.  Offset is the position of
+// the start of the page in the input.  Err is one of the errors above, or a
+// *LimitError.
+type PageError struct {
+  Offset   int64
+  Serial   uint32
+  Sequence uint32
+  Err      error
+}
+
+func (e *PageError) Error() string {
+  return fmt.Sprintf("%s: page %d of stream %x at offset %d.", e.Err.Error(), e.Sequence, e.Serial, e.Offset)
+}
+
+func (e *PageError) Unwrap() error {
+  return e.Err
+}
+
+// A truncated page is also an unexpected EOF, since that's what it used to be
+// reported as.
+func (e *PageError) Is(target error) bool {
+  return target == io.ErrUnexpectedEOF && e.Err == ErrTruncatedPage
+}
+
+// A CRCError is returned for a page whose checksum doesn't match its
+// contents.  Offset is the position of the start of the page in the input.
+type CRCError struct {
+  Serial   uint32
+  Sequence uint32
+  Expected uint32
+  Actual   uint32
+  Offset   int64
+}
+
+func (e *CRCError) Error() string {
+  return fmt.Sprintf("CRC failed on page %d of stream %x at offset %d: expected %x, got %x.", e.Sequence, e.Serial, e.Offset, e.Expected, e.Actual)
+}
+
+func (e *CRCError) Is(target error) bool {
+  return target == ErrCRC
+}
+
+// An UnfinishedError is returned when the input ends before the last page
+// of some of its bitstreams.  Offset is the position of the end of the input.
+type UnfinishedError struct {
+  Serials []uint32
+  Offset  int64
+}
+
+func (e *UnfinishedError) Error() string {
+  return fmt.Sprintf("%d streams did not complete by offset %d: %x.", len(e.Serials), e.Offset, e.Serials)
+}
+
+// An unfinished stream is also an unexpected EOF, since that's what it used
+// to be reported as.
+func (e *UnfinishedError) Is(target error) bool {
+  return target == ErrUnfinishedStreams || target == io.ErrUnexpectedEOF
+}
+
+// A LimitError is returned when a stream needs more than its Limits allow.
+// Limit is the name of the field of Limits that was exceeded, Max is its
+// value and Value is what the stream needed.  Codecs return these too.
+type LimitError struct {
+  Limit string
+  Value int64
+  Max   int64
+}
+
+func (e *LimitError) Error() string {
+  return fmt.Sprintf("Over %s of %d with %d", e.Limit, e.Max, e.Value)
+}
+
+func (e *LimitError) Is(target error) bool {
+  return target == ErrLimitExceeded
+}
@@ -1,12 +1,12 @@
 package ogg
 
 import (
-  "errors"
+  "bufio"
+  "context"
   "io"
   "encoding/binary"
-  "hash/crc32"
-  "fmt"
   "bytes"
+  "sync"
 )
 
 type HeaderFixed struct {
@@ -32,50 +32,192 @@ type Page struct {
 }
 
 type Packet struct {
-  Granule_position     uint64
+  // The granule position of the page the packet ends on.  As only the last
+  // packet to end on a page has a known position, every other packet has
+  // NoGranulePosition.
+  Granule_position uint64
+
+  // The sequence number of the page the packet ends on
   Page_sequence_number uint32
-  Data                 []byte
+
+  Data []byte
+
+  // The serial number of the packet's bitstream
+  Serial uint32
+
+  // Packets are numbered from 0 in the order they are read, so unless some
+  // were lost or reading started part way through the bitstream this is the
+  // packet's position in it.
+  Packet_number int64
+
+  // Bos is set on the first packet of a bitstream and Eos on the last one.
+  // Continued is set if the packet started on an earlier page.
+  Bos       bool
+  Eos       bool
+  Continued bool
 }
 
+// A Codec decodes the packets of a single logical bitstream.  Packets are
+// given to it one at a time, in order, and Packet returns once the packet
+// has been dealt with.  Close is called after the last packet, or when
+// decoding stops early, and returns once everything the codec is still
+// doing has finished.  An error from either stops decoding.
 type Codec interface {
-  Input() chan<- Packet
+  Packet(packet Packet) error
+  Close() error
+}
+
+// Parameters are the format parameters of a bitstream that a player needs
+// to know about.  They are zero if the format isn't known.
+type Parameters struct {
+  Channels    int
+  Sample_rate int
+}
+
+// A Describer is a Codec that can read the parameters of a bitstream from
+// its first packet, without changing the state of the codec.  It also says
+// how many header packets the bitstream starts with, including the first.
+// If the packet isn't valid ok is false.
+type Describer interface {
+  Describe(first []byte) (params Parameters, header_packets int, ok bool)
+}
+
+// A Limited codec is given the Limits that Decode was called with before its
+// first packet, so that it can enforce the ones that apply to it.
+type Limited interface {
+  SetLimits(limits Limits)
+}
+
+// A Stream is a single logical bitstream of a Link
+type Stream struct {
+  Serial     uint32
+  Parameters Parameters
+
+  // The header packets of the bitstream, the first one is the packet on its
+  // first page.  If the codec isn't a Describer only that one is known.
+  Headers [][]byte
 }
 
-var ogg_table *crc32.Table
+// A Link is one section of a chained file, in which a set of bitstreams
+// starts, is played together and ends before the next link starts.  Most
+// files have a single link holding a single bitstream.  Internet radio dumps
+// and concatenated files have a link for each track.
+type Link struct {
+  // Links are numbered from 0 in the order they appear in the file
+  Index int
+
+  // The offset of the first page of the link and of the byte after its last
+  // page.  End is only known once the link has ended.
+  Offset int64
+  End    int64
+
+  // The bitstreams in the order that their first pages appear
+  Streams []Stream
+}
+
+// Parameters returns the parameters of the first bitstream in the link that
+// has any, which for an audio file are those of its audio.
+func (link Link) Parameters() Parameters {
+  for _, stream := range link.Streams {
+    if stream.Parameters != (Parameters{}) {
+      return stream.Parameters
+    }
+  }
+  return Parameters{}
+}
+
+// The Ogg CRC is the unreflected CRC-32 with polynomial 0x04c11db7, an
+// initial value of 0 and no final xor.  hash/crc32 only does reflected CRCs,
+// so it can't be used.
+var ogg_table [256]uint32
+
+type oggCRC uint32
+
+func (crc *oggCRC) Write(p []byte) (int, error) {
+  c := uint32(*crc)
+  for _, b := range p {
+    c = (c << 8) ^ ogg_table[byte(c>>24)^b]
+  }
+  *crc = oggCRC(c)
+  return len(p), nil
+}
 
 type Format func() Codec
 
+// formats is shared by every stream being decoded, so it is guarded by
+// formats_mutex in case a format is registered while streams are decoding.
 var formats map[string]Format
+var formats_mutex sync.RWMutex
 
 func init() {
-  ogg_table = crc32.MakeTable(0x04c11db7)
+  for i := range ogg_table {
+    r := uint32(i) << 24
+    for j := 0; j < 8; j++ {
+      if r&0x80000000 != 0 {
+        r = (r << 1) ^ 0x04c11db7
+      } else {
+        r <<= 1
+      }
+    }
+    ogg_table[i] = r
+  }
   formats = make(map[string]Format)
 }
 
 func RegisterFormat(magic string, format Format) {
+  formats_mutex.Lock()
+  defer formats_mutex.Unlock()
   formats[magic] = format
 }
 
+// GetCodec returns a new codec for the bitstream that page is the first page
+// of, or nil if it isn't in a registered format.
 func GetCodec(page Page) Codec {
+  _, format := detectFormat(page.Data)
+  if format == nil {
+    return nil
+  }
+  return format()
+}
+
+// detectFormat returns the magic string and Format of the registered format
+// that the first packet of a bitstream belongs to, or "" and nil if it
+// doesn't match any of them.
+func detectFormat(first []byte) (string, Format) {
+  formats_mutex.RLock()
+  defer formats_mutex.RUnlock()
   for magic, format := range formats {
-    if len(page.Data) >= len(magic) && string(page.Data[0:len(magic)]) == magic {
-      return format()
+    if len(first) >= len(magic) && string(first[0:len(magic)]) == magic {
+      return magic, format
     }
   }
-  fmt.Printf("Unknown format: %s\n", string(page.Data))
-  return nil
+  return "", nil
 }
 
+// DecodePage reads a single page from in.  It doesn't know where in the
+// input in is, so the offsets in the errors it returns are 0.
 func DecodePage(in io.Reader) (Page, error) {
   var page Page
   err := binary.Read(in, binary.LittleEndian, &page.HeaderFixed)
+  if err == io.EOF {
+    return page, err
+  }
+  if err == io.ErrUnexpectedEOF {
+    return page, &PageError{Err: ErrTruncatedPage}
+  }
   if err != nil {
     return page, err
   }
+  if string(page.Capture_pattern[:]) != "OggS" {
+    return page, &PageError{Err: ErrCapturePattern}
+  }
+  if page.Version != 0 {
+    return page, &PageError{Serial: page.Bitstream_serial_number, Sequence: page.Page_sequence_number, Err: ErrVersion}
+  }
   page.Segment_table = make([]uint8, int(page.Page_segments))
   _, err = io.ReadFull(in, page.Segment_table)
   if err != nil {
-    return page, err
+    return page, truncated(page, err)
   }
 
   remaining_data := 0
@@ -85,74 +227,713 @@ func DecodePage(in io.Reader) (Page, error) {
   page.Data = make([]byte, remaining_data)
   _, err = io.ReadFull(in, page.Data)
   if err != nil {
-    return page, err
+    return page, truncated(page, err)
   }
   // The checksum is made by zeroing the checksum value and CRC-ing the entire page
   checksum := page.Crc_checksum
   page.Crc_checksum = 0
-  crc := crc32.New(ogg_table)
-  binary.Write(crc, binary.LittleEndian, &page.HeaderFixed)
+  var crc oggCRC
+  binary.Write(&crc, binary.LittleEndian, &page.HeaderFixed)
   crc.Write(page.Segment_table)
   crc.Write(page.Data)
+  page.Crc_checksum = checksum
 
-  if crc.Sum32() != checksum {
-    // TODO: Figure out why this CRC isn't working
-    //    return page, os.NewError(fmt.Sprintf("CRC failed: expected %x, got %x.", checksum, crc.Sum32()))
+  if uint32(crc) != checksum {
+    // The whole page has been read, so the caller can carry on with the next
+    // page if it wants to.
+    return page, &CRCError{page.Bitstream_serial_number, page.Page_sequence_number, checksum, uint32(crc), 0}
   }
   return page, nil
 }
 
+// truncated turns running out of input part way through a page into a
+// PageError.
+func truncated(page Page, err error) error {
+  if err != io.EOF && err != io.ErrUnexpectedEOF {
+    return err
+  }
+  return &PageError{Serial: page.Bitstream_serial_number, Sequence: page.Page_sequence_number, Err: ErrTruncatedPage}
+}
+
+// Options control how strict readers are about damaged streams.  The zero
+// value is strict.
+type Options struct {
+  // If Skip_corrupt_pages is set pages that fail their CRC are skipped,
+  // otherwise reading stops with a *CRCError.  Decode also skips pages that
+  // start a bitstream twice or belong to one that never started, rather than
+  // stopping with a *PageError.
+  Skip_corrupt_pages bool
+
+  // If Skip_corrupt_pages is set and Corrupt_page isn't nil it is called for
+  // every page that is skipped.  The bytes of a skipped page are passed to
+  // Resync along with any other junk before the next page.
+  Corrupt_page func(page Page, err *CRCError)
+
+  // If Resync isn't nil it is called whenever bytes had to be skipped to
+  // find the next page, with the number of bytes skipped.
+  Resync func(skipped int)
+
+  // The rest are only used by Decode, which calls them as it works through
+  // the links of a chained file, in order.
+
+  // Link is called once the headers of every bitstream in a link have been
+  // read.
+  Link func(link Link)
+
+  // Link_end is called once every bitstream in a link has ended.
+  Link_end func(link Link)
+
+  // Format_change is called just before Link when the channel count or
+  // sample rate of a link differs from the link before it.
+  Format_change func(previous, link Link)
+
+  // Limits bound how much memory a stream can make readers and codecs use
+  Limits Limits
+}
+
+// Limits protect against streams that ask for far more memory than any real
+// stream needs, which is easy for a small malicious file to do.  Anything
+// over a limit gives a *LimitError before the memory is allocated.  Fields
+// that are zero use the value in DefaultLimits.
+type Limits struct {
+  // The most channels a codec will decode
+  Max_channels int
+
+  // The most bytes of comment data, including the vendor string and the
+  // length of each comment
+  Max_comment_bytes int
+
+  // The most entries in a single codebook
+  Max_codebook_entries int
+
+  // The most bytes that the tables built from a setup header can use
+  Max_setup_memory int
+
+  // The largest page that will be read, including its header
+  Max_page_size int
+
+  // The largest packet that will be put together from pages
+  Max_packet_size int
+}
+
+// DefaultLimits are generous enough for any ordinary stream, including ones
+// with cover art in their comments.  The default page size is the largest
+// that the format allows.
+var DefaultLimits = Limits{
+  Max_channels:         255,
+  Max_comment_bytes:    16 << 20,
+  Max_codebook_entries: 1 << 20,
+  Max_setup_memory:     64 << 20,
+  Max_page_size:        max_page_size,
+  Max_packet_size:      64 << 20,
+}
+
+// WithDefaults returns limits with every zero field replaced by the one from
+// DefaultLimits.
+func (limits Limits) WithDefaults() Limits {
+  if limits.Max_channels == 0 {
+    limits.Max_channels = DefaultLimits.Max_channels
+  }
+  if limits.Max_comment_bytes == 0 {
+    limits.Max_comment_bytes = DefaultLimits.Max_comment_bytes
+  }
+  if limits.Max_codebook_entries == 0 {
+    limits.Max_codebook_entries = DefaultLimits.Max_codebook_entries
+  }
+  if limits.Max_setup_memory == 0 {
+    limits.Max_setup_memory = DefaultLimits.Max_setup_memory
+  }
+  if limits.Max_page_size == 0 {
+    limits.Max_page_size = DefaultLimits.Max_page_size
+  }
+  if limits.Max_packet_size == 0 {
+    limits.Max_packet_size = DefaultLimits.Max_packet_size
+  }
+  return limits
+}
+
+// The largest possible page, a header with 255 segments of 255 bytes each
+const max_page_size = 27 + 255 + 255*255
+
+// A PageReader reads pages one after another, applying its Options to any
+// that are damaged.  If it finds something other than a page where a page
+// should be, such as a tag before the first page or the middle of a page
+// when joining a live stream, it scans forward for the next page.
+type PageReader struct {
+  in      *bufio.Reader
+  options Options
+
+  // Bytes read from in so far
+  offset int64
+
+  // The offset of the last page read
+  page_offset int64
+
+  // Bytes skipped while looking for pages so far
+  skipped int64
+}
+
+func NewPageReader(in io.Reader, options Options) *PageReader {
+  options.Limits = options.Limits.WithDefaults()
+  return &PageReader{in: bufio.NewReaderSize(in, max_page_size), options: options}
+}
+
+// Offset returns the position of the start of the last page read, relative
+// to where the PageReader started reading.
+func (pr *PageReader) Offset() int64 {
+  return pr.page_offset
+}
+
+// Skipped returns the total number of bytes that have been skipped because
+// they weren't part of a page.
+func (pr *PageReader) Skipped() int64 {
+  return pr.skipped
+}
+
+func (pr *PageReader) discard(n int) {
+  pr.in.Discard(n)
+  pr.offset += int64(n)
+}
+
+// peekPage returns the bytes of the page that starts at the current
+// position, if there's a complete page there.
+func (pr *PageReader) peekPage() ([]byte, error) {
+  header, err := pr.in.Peek(27)
+  if err != nil {
+    return header, err
+  }
+  size := 27 + int(header[26])
+  segments, err := pr.in.Peek(size)
+  if err != nil {
+    return segments, err
+  }
+  for _, seg_len := range segments[27:] {
+    size += int(seg_len)
+  }
+  return pr.in.Peek(size)
+}
+
+// ReadPage returns the next page that passes its CRC, or the next one that
+// doesn't if corrupt pages aren't being skipped.  Once there are no more
+// pages it returns io.EOF, or a *PageError matching ErrTruncatedPage if the
+// input ends part way through a page.
+func (pr *PageReader) ReadPage() (Page, error) {
+  // While hunting for a page anything that looks like a page but isn't
+  // valid is just part of the junk being skipped.
+  hunting := false
+  skipped := 0
+  for {
+    data, err := pr.peekPage()
+    if len(data) == 0 {
+      pr.reportSkipped(skipped)
+      return Page{}, err
+    }
+    if len(data) < 4 || string(data[0:4]) != "OggS" {
+      hunting = true
+      n, err := pr.nextCapture()
+      if n == 0 {
+        // Nothing left but junk
+        pr.discard(pr.in.Buffered())
+        pr.reportSkipped(skipped + len(data))
+        return Page{}, err
+      }
+      pr.discard(n)
+      skipped += n
+      continue
+    }
+    if err != nil {
+      if hunting {
+        pr.discard(1)
+        skipped++
+        continue
+      }
+      pr.reportSkipped(skipped)
+      page_err := &PageError{Offset: pr.offset, Err: ErrTruncatedPage}
+      if len(data) >= 22 {
+        page_err.Serial = binary.LittleEndian.Uint32(data[14:18])
+        page_err.Sequence = binary.LittleEndian.Uint32(data[18:22])
+      }
+      return Page{}, page_err
+    }
+
+    if len(data) > pr.options.Limits.Max_page_size {
+      if hunting {
+        pr.discard(1)
+        skipped++
+        continue
+      }
+      // The page is skipped, so the caller can carry on with the next one
+      pr.reportSkipped(skipped)
+      pr.page_offset = pr.offset
+      pr.discard(len(data))
+      return Page{}, &PageError{
+        Offset:   pr.page_offset,
+        Serial:   binary.LittleEndian.Uint32(data[14:18]),
+        Sequence: binary.LittleEndian.Uint32(data[18:22]),
+        Err:      &LimitError{"Max_page_size", int64(len(data)), int64(pr.options.Limits.Max_page_size)},
+      }
+    }
+
+    page, err := DecodePage(bytes.NewReader(data))
+    if err != nil && hunting {
+      pr.discard(1)
+      skipped++
+      continue
+    }
+    pr.reportSkipped(skipped)
+    skipped = 0
+    pr.page_offset = pr.offset
+
+    switch e := err.(type) {
+    case *PageError:
+      e.Offset = pr.page_offset
+    case *CRCError:
+      e.Offset = pr.page_offset
+    }
+    crc_err, ok := err.(*CRCError)
+    if !ok || !pr.options.Skip_corrupt_pages {
+      pr.discard(len(data))
+      return page, err
+    }
+    if pr.options.Corrupt_page != nil {
+      pr.options.Corrupt_page(page, crc_err)
+    }
+    // The length of the page came from its segment table, which might be
+    // what was damaged, so rather than skipping that much we look for the
+    // next capture pattern after this one, the same as libogg does.  The
+    // rest of the page is counted as skipped.
+    pr.discard(1)
+    skipped = 1
+    hunting = true
+  }
+}
+
+// nextCapture returns how far it is to the next capture pattern in the
+// buffered input, not counting one at the current position.  If there isn't
+// one it returns how much of the buffered input can be skipped, which is
+// everything but the last few bytes in case they're the start of a capture
+// pattern.  At the end of the input it returns 0 and the error.
+func (pr *PageReader) nextCapture() (int, error) {
+  n := pr.in.Buffered()
+  for {
+    buffered, err := pr.in.Peek(n)
+    if i := bytes.Index(buffered[1:], []byte("OggS")); i >= 0 {
+      return i + 1, nil
+    }
+    if len(buffered) > 4 {
+      return len(buffered) - 3, nil
+    }
+    if err != nil {
+      return 0, err
+    }
+    // Not enough buffered to tell, so read some more
+    n = len(buffered) + 1
+  }
+}
+
+func (pr *PageReader) reportSkipped(skipped int) {
+  if skipped == 0 {
+    return
+  }
+  pr.skipped += int64(skipped)
+  if pr.options.Resync != nil {
+    pr.options.Resync(skipped)
+  }
+}
+
 type codecBuffer struct {
-  codec  Codec
-  buffer *bytes.Buffer
+  codec   Codec
+  packets *PacketReader
+
+  // The index of the bitstream in its link's Streams, and the number of its
+  // header packets that haven't been read yet.
+  stream  int
+  headers int
+}
+
+// chain keeps track of the links of a chained file for Decode
+type chain struct {
+  options Options
+
+  // The link being read, previous is the one before it.  link is nil
+  // between links.
+  link     *Link
+  previous *Link
+
+  // Set once a page that isn't the first of a bitstream has been seen,
+  // after which no more bitstreams should be joining the link.
+  started bool
+
+  // Set once Link has been called for the current link
+  announced bool
+
+  // The streams of the current link that haven't ended yet
+  streams map[uint32]*codecBuffer
+
+  next_index int
+}
+
+// begin adds a bitstream to the current link, or starts a new link if there
+// isn't one.
+func (ch *chain) begin(page Page, offset int64) *codecBuffer {
+  if ch.link == nil {
+    ch.link = &Link{Index: ch.next_index, Offset: offset}
+    ch.next_index++
+    ch.started = false
+    ch.announced = false
+  }
+  ch.link.Streams = append(ch.link.Streams, Stream{Serial: page.Bitstream_serial_number})
+  cb := &codecBuffer{
+    codec:   GetCodec(page),
+    packets: newBitstreamReader(page.Bitstream_serial_number, ch.options.Limits),
+    stream:  len(ch.link.Streams) - 1,
+    headers: 1,
+  }
+  if limited, ok := cb.codec.(Limited); ok {
+    limited.SetLimits(ch.options.Limits)
+  }
+  ch.streams[page.Bitstream_serial_number] = cb
+  return cb
+}
+
+// header records a header packet of a bitstream in the current link
+func (ch *chain) header(cb *codecBuffer, packet []byte) {
+  stream := &ch.link.Streams[cb.stream]
+  if len(stream.Headers) == 0 {
+    if describer, ok := cb.codec.(Describer); ok {
+      params, header_packets, ok := describer.Describe(packet)
+      if ok && header_packets > 0 {
+        stream.Parameters = params
+        cb.headers = header_packets
+      }
+    }
+  }
+  stream.Headers = append(stream.Headers, packet)
+  cb.headers--
+}
+
+// announce calls Link once every bitstream in the link has started and
+// finished its headers, or straight away if force is set.
+func (ch *chain) announce(force bool) {
+  if ch.announced {
+    return
+  }
+  if !force {
+    if !ch.started {
+      return
+    }
+    for _, cb := range ch.streams {
+      if cb.headers > 0 {
+        return
+      }
+    }
+  }
+  ch.announced = true
+  if ch.previous != nil && ch.previous.Parameters() != ch.link.Parameters() && ch.options.Format_change != nil {
+    ch.options.Format_change(*ch.previous, *ch.link)
+  }
+  if ch.options.Link != nil {
+    ch.options.Link(*ch.link)
+  }
+}
+
+// end removes a bitstream that has ended, and finishes the link if it was
+// the last one.  end_offset is the offset of the byte after its last page.
+func (ch *chain) end(serial uint32, end_offset int64) {
+  delete(ch.streams, serial)
+  if len(ch.streams) > 0 {
+    return
+  }
+  ch.announce(true)
+  ch.link.End = end_offset
+  if ch.options.Link_end != nil {
+    ch.options.Link_end(*ch.link)
+  }
+  ch.previous = ch.link
+  ch.link = nil
 }
 
 func Decode(in io.Reader) error {
-  fmt.Printf("")
-  streams := make(map[uint32]*codecBuffer)
-  var page Page
-  var err error
-  for ; err == nil; page, err = DecodePage(in) {
+  return DecodeContextWithOptions(context.Background(), in, Options{})
+}
+
+func DecodeWithOptions(in io.Reader, options Options) error {
+  return DecodeContextWithOptions(context.Background(), in, options)
+}
+
+func DecodeContext(ctx context.Context, in io.Reader) error {
+  return DecodeContextWithOptions(ctx, in, Options{})
+}
+
+// DecodeContextWithOptions sends the packets of every bitstream in in to the
+// codec registered for its format, and returns once every codec has finished.
+// Chained files are handled link by link, and the options can be used to
+// follow the links as they are read.  Decoding stops at the first error from
+// a codec, which is returned.  ctx is checked between pages, if it is
+// cancelled decoding stops and ctx.Err() is returned.  Any codecs that are
+// still open when decoding stops are closed.
+func DecodeContextWithOptions(ctx context.Context, in io.Reader, options Options) error {
+  pages := NewPageReader(in, options)
+  ch := chain{options: options, streams: make(map[uint32]*codecBuffer)}
+  defer func() {
+    for _, cb := range ch.streams {
+      if cb.codec != nil {
+        cb.codec.Close()
+      }
+    }
+  }()
+  for {
+    if err := ctx.Err(); err != nil {
+      return err
+    }
+    page, err := pages.ReadPage()
+    if err == io.EOF {
+      break
+    }
+    if err != nil {
+      return err
+    }
     serial := page.Bitstream_serial_number
     if page.Header_type&0x2 != 0 {
       // First packet in a bitstream, shouldn't already have a codec for it
       // check for one first, then make one
-      if _, ok := streams[serial]; ok {
-        // TODO: issue a warning, there was already a codec here
-        continue
+      if _, ok := ch.streams[serial]; ok {
+        if options.Skip_corrupt_pages {
+          continue
+        }
+        return &PageError{pages.Offset(), serial, page.Page_sequence_number, ErrDuplicateBOS}
       }
-      streams[serial] = &codecBuffer{GetCodec(page), bytes.NewBuffer(nil)}
+      ch.begin(page, pages.Offset())
+    } else if ch.link != nil {
+      ch.started = true
     }
-    cb, ok := streams[serial]
+    cb, ok := ch.streams[serial]
     if !ok {
-      fmt.Printf("!ok\n")
-      continue
+      if options.Skip_corrupt_pages {
+        continue
+      }
+      return &PageError{pages.Offset(), serial, page.Page_sequence_number, ErrMissingBOS}
+    }
+    if err := cb.packets.readPage(page, pages.Offset()); err != nil {
+      return err
     }
-    for _, seg_len := range page.Segment_table {
-      cb.buffer.Write(page.Data[0:seg_len])
-      page.Data = page.Data[seg_len:]
-      if seg_len != 255 {
-        cb.codec.Input() <- Packet{
-          page.Granule_position,
-          page.Page_sequence_number,
-          cb.buffer.Bytes(),
+    for _, packet := range cb.packets.packets {
+      if cb.headers > 0 {
+        ch.header(cb, packet.Data)
+      }
+      if cb.codec != nil {
+        if err := cb.codec.Packet(packet); err != nil {
+          return err
         }
-        cb.buffer = bytes.NewBuffer(nil)
       }
     }
+    cb.packets.packets = nil
+    ch.announce(false)
     if page.Header_type&0x4 != 0 {
-      close(cb.codec.Input())
-      streams[serial] = nil, false
+      if cb.codec != nil {
+        // The codec is done with whether or not it closes cleanly
+        codec := cb.codec
+        cb.codec = nil
+        if err := codec.Close(); err != nil {
+          return err
+        }
+      }
+      ch.end(serial, pages.offset)
     }
   }
-  if err == nil {
-    return errors.New("Quit processing without reaching EOF")
+  if len(ch.streams) > 0 {
+    unfinished := &UnfinishedError{Offset: pages.offset}
+    for _, stream := range ch.link.Streams {
+      if _, ok := ch.streams[stream.Serial]; ok {
+        unfinished.Serials = append(unfinished.Serials, stream.Serial)
+      }
+    }
+    return unfinished
   }
-  if err != io.EOF {
-    return err
+  return nil
+}
+
+// A PacketReader reads the packets of a single logical bitstream one at a
+// time, by default the first one that begins in the input.  Pages from any
+// other bitstream are skipped.
+type PacketReader struct {
+  pages   *PageReader
+  serial  uint32
+  started bool
+  done    bool
+
+  // If choose isn't nil the bitstream read is the first one it picks
+  choose func(stream Bitstream) bool
+
+  // The sequence number that the next page should have, if it doesn't then
+  // a page has gone missing.
+  next_sequence uint32
+
+  // Packets that have been completed but not returned yet
+  packets []Packet
+
+  // The start of a packet that continues on the next page
+  partial []byte
+
+  // Set when the start of a packet was lost, the rest of it has to be
+  // skipped.
+  skipping bool
+
+  // The number of packets completed so far
+  packet_number int64
+
+  limits Limits
+}
+
+// newBitstreamReader returns a PacketReader with no input of its own, for
+// splitting up the pages of a bitstream that are read elsewhere.
+func newBitstreamReader(serial uint32, limits Limits) *PacketReader {
+  return &PacketReader{serial: serial, started: true, limits: limits.WithDefaults()}
+}
+
+func NewPacketReader(in io.Reader) *PacketReader {
+  return NewPacketReaderWithOptions(in, Options{})
+}
+
+func NewPacketReaderWithOptions(in io.Reader, options Options) *PacketReader {
+  return &PacketReader{pages: NewPageReader(in, options), limits: options.Limits.WithDefaults()}
+}
+
+// NewPacketReaderChoosing returns a PacketReader for the first bitstream
+// that choose picks, it is called with each bitstream as its first page is
+// read until it returns true.
+func NewPacketReaderChoosing(in io.Reader, options Options, choose func(stream Bitstream) bool) *PacketReader {
+  pr := NewPacketReaderWithOptions(in, options)
+  pr.choose = choose
+  return pr
+}
+
+// NewPacketReaderAt returns a PacketReader for the bitstream with the given
+// serial number that starts reading wherever in is, for example just after a
+// seek.  A packet that started before that point is skipped.
+func NewPacketReaderAt(in io.Reader, serial uint32, options Options) *PacketReader {
+  pr := NewPacketReaderWithOptions(in, options)
+  pr.serial = serial
+  pr.started = true
+  return pr
+}
+
+// Serial returns the serial number of the bitstream being read, it is only
+// valid once the first packet has been read.
+func (pr *PacketReader) Serial() uint32 {
+  return pr.serial
+}
+
+// BytesRead returns the number of bytes of input used up by the pages read so
+// far, including any junk and pages from other bitstreams.
+func (pr *PacketReader) BytesRead() int64 {
+  return pr.pages.offset
+}
+
+// ReadPacket returns the next packet in the bitstream.  Once the last packet
+// has been read it returns io.EOF, if the input ends before the end of the
+// bitstream it returns an *UnfinishedError.  A packet larger than
+// Max_packet_size is dropped and reported with a *PageError, after which
+// reading can carry on.
+func (pr *PacketReader) ReadPacket() (Packet, error) {
+  for len(pr.packets) == 0 {
+    if pr.done {
+      return Packet{}, io.EOF
+    }
+    page, err := pr.pages.ReadPage()
+    if err == io.EOF {
+      if !pr.started {
+        return Packet{}, io.EOF
+      }
+      return Packet{}, &UnfinishedError{[]uint32{pr.serial}, pr.pages.offset}
+    }
+    if err != nil {
+      return Packet{}, err
+    }
+    if !pr.started {
+      if page.Header_type&0x2 == 0 {
+        continue
+      }
+      if pr.choose != nil && !pr.choose(describeBitstream(page)) {
+        continue
+      }
+      pr.serial = page.Bitstream_serial_number
+      pr.started = true
+    }
+    if page.Bitstream_serial_number != pr.serial {
+      continue
+    }
+    if err := pr.readPage(page, pr.pages.Offset()); err != nil {
+      return Packet{}, err
+    }
   }
-  if len(streams) > 0 {
-    return errors.New(fmt.Sprintf("%d streams did not complete.", len(streams)))
+  packet := pr.packets[0]
+  pr.packets = pr.packets[1:]
+  return packet, nil
+}
+
+// readPage splits a page up into packets, joining the first one to the end
+// of the previous page if it is continued.  offset is where the page is in
+// the input, for the error if a packet is too large.  The rest of the page
+// is still split up when that happens.
+func (pr *PacketReader) readPage(page Page, offset int64) error {
+  var err error
+  // If a page was skipped any packet that was continued onto it is lost, and
+  // so is the rest of it on this page.
+  lost := page.Page_sequence_number != pr.next_sequence && page.Header_type&0x2 == 0
+  pr.next_sequence = page.Page_sequence_number + 1
+  if page.Header_type&0x1 == 0 || lost {
+    pr.partial = nil
   }
-  return nil
+  if page.Header_type&0x1 == 0 {
+    pr.skipping = false
+  } else if lost {
+    pr.skipping = true
+  }
+  // Only the first packet completed on a page can have started on an
+  // earlier one.
+  continued := page.Header_type&0x1 != 0 && len(pr.partial) > 0
+  first := len(pr.packets)
+  data := page.Data
+  for _, seg_len := range page.Segment_table {
+    if pr.skipping {
+      data = data[seg_len:]
+      pr.skipping = seg_len == 255
+      continue
+    }
+    if size := len(pr.partial) + int(seg_len); size > pr.limits.Max_packet_size {
+      if err == nil {
+        limit_err := &LimitError{"Max_packet_size", int64(size), int64(pr.limits.Max_packet_size)}
+        err = &PageError{offset, pr.serial, page.Page_sequence_number, limit_err}
+      }
+      data = data[seg_len:]
+      pr.partial = nil
+      pr.skipping = seg_len == 255
+      continue
+    }
+    pr.partial = append(pr.partial, data[0:seg_len]...)
+    data = data[seg_len:]
+    if seg_len != 255 {
+      pr.packets = append(pr.packets, Packet{
+        Granule_position:     NoGranulePosition,
+        Page_sequence_number: page.Page_sequence_number,
+        Data:                 pr.partial,
+        Serial:               pr.serial,
+        Packet_number:        pr.packet_number,
+        Bos:                  pr.packet_number == 0 && page.Header_type&0x2 != 0,
+        Continued:            continued,
+      })
+      pr.packet_number++
+      pr.partial = nil
+      continued = false
+    }
+  }
+  if last := len(pr.packets) - 1; last >= first {
+    pr.packets[last].Granule_position = page.Granule_position
+    pr.packets[last].Eos = page.Header_type&0x4 != 0
+  }
+  if page.Header_type&0x4 != 0 {
+    pr.done = true
+  }
+  return err
 }
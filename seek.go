@@ -0,0 +1,140 @@
+package ogg
+
+import (
+  "errors"
+  "io"
+)
+
+// Once the range being bisected is this small it is just scanned
+const seek_scan_size = 2 * max_page_size
+
+// SeekGranule finds the first page of the bitstream with the given serial
+// number whose granule position is at least granule_position, which is the
+// page on which the packet containing that position ends.  It bisects over
+// the pages in rs rather than reading them all, so it works on long files.
+// Pages of other bitstreams and pages on which no packet ends are ignored.
+// On success rs is left at the start of the page that was found.  If there
+// is no such page it returns io.EOF.
+func SeekGranule(rs io.ReadSeeker, serial uint32, granule_position uint64) (Page, error) {
+  size, err := rs.Seek(0, 2)
+  if err != nil {
+    return Page{}, err
+  }
+
+  // Every matching page that starts before begin has a granule position
+  // that's too small, the page we want starts before end unless it's the
+  // first one at or after begin.
+  var begin, end int64 = 0, size
+  for end-begin > seek_scan_size {
+    middle := begin + (end-begin)/2
+    page, next, err := nextGranulePage(rs, serial, middle, end)
+    if err == io.EOF {
+      end = middle
+      continue
+    }
+    if err != nil {
+      return Page{}, err
+    }
+    if page.Granule_position < granule_position {
+      begin = next
+    } else {
+      end = middle
+    }
+  }
+
+  if _, err := rs.Seek(begin, 0); err != nil {
+    return Page{}, err
+  }
+  pr := NewPageReader(rs, Options{Skip_corrupt_pages: true})
+  for {
+    page, err := pr.ReadPage()
+    if errors.Is(err, io.ErrUnexpectedEOF) {
+      err = io.EOF
+    }
+    if err != nil {
+      return Page{}, err
+    }
+    if page.Bitstream_serial_number != serial || page.Granule_position == NoGranulePosition {
+      continue
+    }
+    if page.Granule_position >= granule_position {
+      _, err = rs.Seek(begin+pr.Offset(), 0)
+      return page, err
+    }
+  }
+}
+
+// nextGranulePage returns the first page of the bitstream that has a granule
+// position and starts at or after begin, but before end.  It also returns the
+// offset of the byte after it.
+func nextGranulePage(rs io.ReadSeeker, serial uint32, begin, end int64) (page Page, next int64, err error) {
+  if _, err = rs.Seek(begin, 0); err != nil {
+    return
+  }
+  // Pages are found by scanning from an arbitrary point, so anything that
+  // doesn't check out is treated the same as any other junk.
+  pr := NewPageReader(rs, Options{Skip_corrupt_pages: true})
+  for {
+    page, err = pr.ReadPage()
+    if errors.Is(err, io.ErrUnexpectedEOF) {
+      err = io.EOF
+    }
+    if err != nil {
+      return
+    }
+    if begin+pr.Offset() >= end {
+      err = io.EOF
+      return
+    }
+    if page.Bitstream_serial_number == serial && page.Granule_position != NoGranulePosition {
+      next = begin + pr.offset
+      return
+    }
+  }
+}
+
+// LastGranule returns the granule position of the last page of the
+// bitstream with the given serial number that has one.  It scans backwards
+// from the end of rs a chunk at a time, so only the end of the file is read.
+// If the bitstream has no such pages it returns io.EOF.
+func LastGranule(rs io.ReadSeeker, serial uint32) (uint64, error) {
+  end, err := rs.Seek(0, 2)
+  if err != nil {
+    return 0, err
+  }
+  for end > 0 {
+    begin := end - seek_scan_size
+    if begin < 0 {
+      begin = 0
+    }
+    if _, err := rs.Seek(begin, 0); err != nil {
+      return 0, err
+    }
+    // Pages that start in [begin, end) are read in full even if they run
+    // past end, and the last one with a granule position wins.
+    found := false
+    var granule_position uint64
+    pr := NewPageReader(rs, Options{Skip_corrupt_pages: true})
+    for {
+      page, err := pr.ReadPage()
+      if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+        break
+      }
+      if err != nil {
+        return 0, err
+      }
+      if begin+pr.Offset() >= end {
+        break
+      }
+      if page.Bitstream_serial_number == serial && page.Granule_position != NoGranulePosition {
+        found = true
+        granule_position = page.Granule_position
+      }
+    }
+    if found {
+      return granule_position, nil
+    }
+    end = begin
+  }
+  return 0, io.EOF
+}
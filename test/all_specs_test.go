@@ -8,5 +8,21 @@ import (
 func TestAllSpecs(t *testing.T) {
   r := gospec.NewRunner()
   r.AddSpec(OggSpec)
+  r.AddSpec(PacketReaderSpec)
+  r.AddSpec(DecoderSpec)
+  r.AddSpec(WriterSpec)
+  r.AddSpec(CRCSpec)
+  r.AddSpec(ResyncSpec)
+  r.AddSpec(SeekSpec)
+  r.AddSpec(DecoderSeekSpec)
+  r.AddSpec(LengthSpec)
+  r.AddSpec(ChainSpec)
+  r.AddSpec(DemuxSpec)
+  r.AddSpec(VorbisSelectionSpec)
+  r.AddSpec(DecodeContextSpec)
+  r.AddSpec(ErrorsSpec)
+  r.AddSpec(VorbisHeaderErrorSpec)
+  r.AddSpec(LimitsSpec)
+  r.AddSpec(MalformedSpec)
   gospec.MainGoTest(r, t)
 }
@@ -4,7 +4,16 @@ import (
   . "gospec"
   "gospec"
   "ogg"
-  _ "ogg/vorbis"
+  "ogg/vorbis"
+  "bytes"
+  "context"
+  "encoding/binary"
+  "errors"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "math"
+  "math/rand"
   "os"
 )
 
@@ -30,4 +39,1645 @@ func OggSpec(c gospec.Context) {
     err = ogg.Decode(f)
     c.Assume(err, Equals, nil)
   })
+  c.Specify("Decode many files in parallel", func() {
+    // Run with -race, every stream has its own decoder so none of them
+    // should share any state.
+    data, err := ioutil.ReadFile("metroid.ogg")
+    c.Assume(err, Equals, nil)
+    errs := make(chan error)
+    for i := 0; i < 16; i++ {
+      go func() {
+        errs <- ogg.Decode(bytes.NewReader(data))
+      }()
+    }
+    for i := 0; i < 16; i++ {
+      c.Expect(<-errs, Equals, nil)
+    }
+  })
+}
+
+func PacketReaderSpec(c gospec.Context) {
+  data, err := ioutil.ReadFile("metroid.ogg")
+  c.Assume(err, Equals, nil)
+
+  c.Specify("Packets are read in order, starting with the headers", func() {
+    pr := ogg.NewPacketReader(bytes.NewReader(data))
+    var packets [][]byte
+    for {
+      packet, err := pr.ReadPacket()
+      if err != nil {
+        c.Expect(err, Equals, io.EOF)
+        break
+      }
+      packets = append(packets, packet.Data)
+    }
+    c.Expect(pr.Serial(), Equals, uint32(1160424692))
+    c.Assume(len(packets) > 3, IsTrue)
+    c.Expect(string(packets[0][0:7]), Equals, "\x01vorbis")
+    c.Expect(string(packets[1][0:7]), Equals, "\x03vorbis")
+    c.Expect(string(packets[2][0:7]), Equals, "\x05vorbis")
+    for _, packet := range packets[3:] {
+      c.Expect(packet[0]&1, Equals, uint8(0))
+    }
+  })
+
+  c.Specify("A stream that ends early is an unexpected EOF", func() {
+    pr := ogg.NewPacketReader(bytes.NewReader(data[0 : len(data)/2]))
+    var err error
+    for err == nil {
+      _, err = pr.ReadPacket()
+    }
+    c.Expect(errors.Is(err, io.ErrUnexpectedEOF), IsTrue)
+  })
+
+  c.Specify("Only the last packet to end on a page has its granule position", func() {
+    // The first page holds the first packet and the start of the second,
+    // the rest are on the last page.
+    out := bytes.NewBuffer(nil)
+    w := ogg.NewWriter(out, 99)
+    w.Page_size = 100
+    for i, size := range []int{10, 300, 10, 10} {
+      w.WritePacket(make([]byte, size), uint64(100*(i+1)))
+    }
+    w.Close()
+    c.Assume(len(splitPages(out.Bytes())), Equals, 2)
+
+    pr := ogg.NewPacketReader(bytes.NewReader(out.Bytes()))
+    var packets []ogg.Packet
+    for {
+      packet, err := pr.ReadPacket()
+      if err != nil {
+        c.Expect(err, Equals, io.EOF)
+        break
+      }
+      packets = append(packets, packet)
+    }
+    c.Assume(len(packets), Equals, 4)
+    granules := []uint64{100, ogg.NoGranulePosition, ogg.NoGranulePosition, 400}
+    for i, packet := range packets {
+      c.Expect(packet.Serial, Equals, uint32(99))
+      c.Expect(packet.Packet_number, Equals, int64(i))
+      c.Expect(packet.Granule_position, Equals, granules[i])
+      c.Expect(packet.Bos, Equals, i == 0)
+      c.Expect(packet.Eos, Equals, i == 3)
+      c.Expect(packet.Continued, Equals, i == 1)
+    }
+    c.Expect(len(packets[1].Data), Equals, 300)
+    c.Expect(packets[1].Page_sequence_number, Equals, uint32(1))
+  })
+
+  c.Specify("Every page on which a packet ends has one packet with its granule position", func() {
+    pages := 0
+    for _, raw := range splitPages(data) {
+      page, _ := ogg.DecodePage(bytes.NewReader(raw))
+      if page.Granule_position != ogg.NoGranulePosition {
+        pages++
+      }
+    }
+    pr := ogg.NewPacketReader(bytes.NewReader(data))
+    packets := 0
+    for {
+      packet, err := pr.ReadPacket()
+      if err != nil {
+        break
+      }
+      if packet.Granule_position != ogg.NoGranulePosition {
+        packets++
+      }
+    }
+    c.Expect(packets, Equals, pages)
+  })
+}
+
+func DecoderSpec(c gospec.Context) {
+  data, err := ioutil.ReadFile("metroid.ogg")
+  c.Assume(err, Equals, nil)
+
+  c.Specify("The id header is available as soon as the decoder is made", func() {
+    d, err := vorbis.NewDecoder(bytes.NewReader(data))
+    c.Assume(err, Equals, nil)
+    info := d.Info()
+    c.Expect(info.Channels, Equals, 2)
+    c.Expect(info.Sample_rate, Equals, 44100)
+    c.Expect(info.Bitrate_nominal, Equals, 160000)
+    c.Expect(info.Bitrate_maximum, Equals, 0)
+    c.Expect(info.Blocksize_0, Equals, 256)
+    c.Expect(info.Blocksize_1, Equals, 2048)
+  })
+
+  c.Specify("The whole stream can be read as float32", func() {
+    d, err := vorbis.NewDecoder(bytes.NewReader(data))
+    c.Assume(err, Equals, nil)
+    buffer := make([]float32, 4096)
+    total := 0
+    peak := 0.0
+    for {
+      n, err := d.ReadFloat32(buffer)
+      if err != nil {
+        c.Expect(err, Equals, io.EOF)
+        c.Expect(n, Equals, 0)
+        break
+      }
+      c.Expect(n%2, Equals, 0)
+      for _, sample := range buffer[0:n] {
+        peak = math.Max(peak, math.Abs(float64(sample)))
+      }
+      total += n
+    }
+    // The last page's granule position is 185472
+    c.Expect(total/2, Equals, 185472)
+    c.Expect(peak > 0.1, IsTrue)
+    c.Expect(peak < 1.5, IsTrue)
+  })
+
+  c.Specify("Reading int16s in odd sized chunks gives the same samples", func() {
+    floats, err := vorbis.NewDecoder(bytes.NewReader(data))
+    c.Assume(err, Equals, nil)
+    ints, err := vorbis.NewDecoder(bytes.NewReader(data))
+    c.Assume(err, Equals, nil)
+    f := make([]float32, 10000)
+    i := make([]int16, 333)
+    for read := 0; read < 100000; {
+      n, err := ints.ReadInt16(i)
+      c.Assume(err, Equals, nil)
+      c.Expect(n, Equals, 332)
+      m, err := floats.ReadFloat32(f[0:n])
+      c.Assume(err, Equals, nil)
+      c.Assume(m, Equals, n)
+      for j := range i[0:n] {
+        expected := math.Floor(float64(f[j])*32768 + 0.5)
+        expected = math.Max(-32768, math.Min(32767, expected))
+        c.Expect(float64(i[j]), IsWithin(1), expected)
+      }
+      read += n
+    }
+  })
+
+  c.Specify("The end of the stream is trimmed to the last page's granule position", func() {
+    d, err := vorbis.NewDecoder(bytes.NewReader(data))
+    c.Assume(err, Equals, nil)
+    full, err := decodeAll(d)
+    c.Assume(err, Equals, nil)
+
+    pages := splitPages(data)
+    trimmed := withGranules(pages, func(i int, granule int64) int64 {
+      if i == len(pages)-1 {
+        return 185000
+      }
+      return granule
+    })
+    length, err := vorbis.ReadLength(bytes.NewReader(trimmed))
+    c.Assume(err, Equals, nil)
+    c.Expect(length.Samples, Equals, int64(185000))
+    d, err = vorbis.NewDecoder(bytes.NewReader(trimmed))
+    c.Assume(err, Equals, nil)
+    samples, err := decodeAll(d)
+    c.Assume(err, Equals, nil)
+    c.Expect(len(samples), Equals, 2*185000)
+    c.Expect(samples, Equals, full[0:len(samples)])
+  })
+
+  c.Specify("Samples before the first page's granule position are dropped", func() {
+    d, err := vorbis.NewDecoder(bytes.NewReader(data))
+    c.Assume(err, Equals, nil)
+    full, err := decodeAll(d)
+    c.Assume(err, Equals, nil)
+
+    // Every audio page ends 1000 samples earlier, so the first 1000 samples
+    // of the first page come before the start of the stream.
+    trimmed := withGranules(splitPages(data), func(i int, granule int64) int64 {
+      if i < 3 {
+        return granule
+      }
+      return granule - 1000
+    })
+    length, err := vorbis.ReadLength(bytes.NewReader(trimmed))
+    c.Assume(err, Equals, nil)
+    c.Expect(length.Samples, Equals, int64(184472))
+    d, err = vorbis.NewDecoder(bytes.NewReader(trimmed))
+    c.Assume(err, Equals, nil)
+    samples, err := decodeAll(d)
+    c.Assume(err, Equals, nil)
+    c.Expect(len(samples), Equals, 2*184472)
+    c.Expect(samples, Equals, full[2*1000:])
+
+    _, err = d.Seek(5000, 0)
+    c.Assume(err, Equals, nil)
+    samples, err = decodeAll(d)
+    c.Assume(err, Equals, nil)
+    c.Expect(samples, Equals, full[2*6000:])
+  })
+
+  c.Specify("A buffer that can't hold one sample per channel is too short", func() {
+    d, err := vorbis.NewDecoder(bytes.NewReader(data))
+    c.Assume(err, Equals, nil)
+    _, err = d.ReadFloat32(make([]float32, 1))
+    c.Expect(err, Equals, io.ErrShortBuffer)
+  })
+
+  c.Specify("A file without all of the headers can't be decoded", func() {
+    _, err := vorbis.NewDecoder(bytes.NewReader(nil))
+    c.Expect(err, Not(Equals), nil)
+    _, err = vorbis.NewDecoder(bytes.NewReader(data[0:100]))
+    c.Expect(errors.Is(err, io.ErrUnexpectedEOF), IsTrue)
+  })
+
+  c.Specify("A file that ends early reports an unexpected EOF", func() {
+    d, err := vorbis.NewDecoder(bytes.NewReader(data[0 : len(data)/2]))
+    c.Assume(err, Equals, nil)
+    buffer := make([]float32, 4096)
+    for err == nil {
+      _, err = d.ReadFloat32(buffer)
+    }
+    c.Expect(errors.Is(err, io.ErrUnexpectedEOF), IsTrue)
+  })
+}
+
+// referenceCRC computes the Ogg CRC one bit at a time, straight from the
+// definition.
+func referenceCRC(data []byte) uint32 {
+  var crc uint32
+  for _, b := range data {
+    crc ^= uint32(b) << 24
+    for i := 0; i < 8; i++ {
+      if crc&0x80000000 != 0 {
+        crc = (crc << 1) ^ 0x04c11db7
+      } else {
+        crc <<= 1
+      }
+    }
+  }
+  return crc
+}
+
+// splitPages splits raw Ogg data into its pages without checking anything
+func splitPages(data []byte) [][]byte {
+  var pages [][]byte
+  for len(data) >= 27 {
+    size := 27 + int(data[26])
+    for _, seg_len := range data[27:size] {
+      size += int(seg_len)
+    }
+    pages = append(pages, data[0:size])
+    data = data[size:]
+  }
+  return pages
+}
+
+func pageCRCMatches(page []byte) bool {
+  zeroed := append([]byte(nil), page...)
+  copy(zeroed[22:26], []byte{0, 0, 0, 0})
+  crc := referenceCRC(zeroed)
+  return page[22] == byte(crc) && page[23] == byte(crc>>8) && page[24] == byte(crc>>16) && page[25] == byte(crc>>24)
+}
+
+func WriterSpec(c gospec.Context) {
+  c.Specify("The reference CRC matches the pages in metroid.ogg", func() {
+    data, err := ioutil.ReadFile("metroid.ogg")
+    c.Assume(err, Equals, nil)
+    pages := splitPages(data)
+    c.Assume(len(pages), Equals, 28)
+    for _, page := range pages {
+      c.Expect(pageCRCMatches(page), IsTrue)
+    }
+  })
+
+  sizes := []int{0, 1, 254, 255, 256, 510, 4000, 70000, 3, 0}
+  packets := make([][]byte, len(sizes))
+  for i, size := range sizes {
+    packets[i] = make([]byte, size)
+    for j := range packets[i] {
+      packets[i][j] = byte(i*7 + j)
+    }
+  }
+  write := func(page_size int) []byte {
+    out := bytes.NewBuffer(nil)
+    w := ogg.NewWriter(out, 1234)
+    w.Page_size = page_size
+    for i, packet := range packets {
+      c.Assume(w.WritePacket(packet, uint64(100*(i+1))), Equals, nil)
+      if i == 0 {
+        c.Assume(w.Flush(), Equals, nil)
+      }
+    }
+    c.Assume(w.Close(), Equals, nil)
+    return out.Bytes()
+  }
+
+  for _, page_size := range []int{0, 1, 300, 100000} {
+    data := write(page_size)
+    c.Specify(fmt.Sprintf("Written pages are valid with a page size of %d", page_size), func() {
+      pages := splitPages(data)
+      c.Assume(len(pages) > 2, IsTrue)
+      for i, raw := range pages {
+        c.Expect(pageCRCMatches(raw), IsTrue)
+        page, err := ogg.DecodePage(bytes.NewReader(raw))
+        c.Assume(err, Equals, nil)
+        c.Expect(string(page.Capture_pattern[:]), Equals, "OggS")
+        c.Expect(page.Bitstream_serial_number, Equals, uint32(1234))
+        c.Expect(page.Page_sequence_number, Equals, uint32(i))
+        c.Expect(page.Header_type&0x2 != 0, Equals, i == 0)
+        c.Expect(page.Header_type&0x4 != 0, Equals, i == len(pages)-1)
+        if i > 0 {
+          previous, _ := ogg.DecodePage(bytes.NewReader(pages[i-1]))
+          continued := previous.Page_segments > 0 && previous.Segment_table[previous.Page_segments-1] == 255
+          c.Expect(page.Header_type&0x1 != 0, Equals, continued)
+        }
+      }
+
+      // The first packet is flushed onto a page of its own
+      first, _ := ogg.DecodePage(bytes.NewReader(pages[0]))
+      c.Expect(first.Segment_table, Equals, []uint8{0})
+      c.Expect(first.Granule_position, Equals, uint64(100))
+    })
+
+    c.Specify(fmt.Sprintf("Written packets read back the same with a page size of %d", page_size), func() {
+      pr := ogg.NewPacketReader(bytes.NewReader(data))
+      for _, packet := range packets {
+        read, err := pr.ReadPacket()
+        c.Assume(err, Equals, nil)
+        c.Expect(string(read.Data), Equals, string(packet))
+      }
+      _, err := pr.ReadPacket()
+      c.Expect(err, Equals, io.EOF)
+    })
+  }
+
+  c.Specify("Pages end with the granule position of their last complete packet", func() {
+    data := write(300)
+    expected := map[int]bool{}
+    for i := range packets {
+      expected[100*(i+1)] = true
+    }
+    for _, raw := range splitPages(data) {
+      page, _ := ogg.DecodePage(bytes.NewReader(raw))
+      complete := false
+      for _, seg_len := range page.Segment_table {
+        complete = complete || seg_len != 255
+      }
+      if complete {
+        c.Expect(expected[int(page.Granule_position)], IsTrue)
+      } else {
+        c.Expect(page.Granule_position, Equals, ogg.NoGranulePosition)
+      }
+    }
+  })
+
+  c.Specify("Closing a stream with nothing left writes an empty end page", func() {
+    out := bytes.NewBuffer(nil)
+    w := ogg.NewWriter(out, 1)
+    c.Assume(w.WritePacket([]byte{1, 2, 3}, 5), Equals, nil)
+    c.Assume(w.Flush(), Equals, nil)
+    c.Assume(w.Close(), Equals, nil)
+    pages := splitPages(out.Bytes())
+    c.Assume(len(pages), Equals, 2)
+    last, _ := ogg.DecodePage(bytes.NewReader(pages[1]))
+    c.Expect(last.Header_type, Equals, uint8(0x4))
+    c.Expect(len(last.Segment_table), Equals, 0)
+    c.Expect(w.WritePacket([]byte{1}, 6), Not(Equals), nil)
+  })
+}
+
+// withGranules joins pages back together after replacing the granule
+// position of each with the one returned by granule, fixing their CRCs.
+func withGranules(pages [][]byte, granule func(i int, granule int64) int64) []byte {
+  out := bytes.NewBuffer(nil)
+  for i, page := range pages {
+    page = append([]byte(nil), page...)
+    binary.LittleEndian.PutUint64(page[6:14], uint64(granule(i, int64(binary.LittleEndian.Uint64(page[6:14])))))
+    out.Write(fixCRC(page))
+  }
+  return out.Bytes()
+}
+
+// corruptPage returns a copy of data with one byte of the data of the
+// numbered page flipped.
+func corruptPage(data []byte, number int) []byte {
+  corrupt := append([]byte(nil), data...)
+  offset := 0
+  for _, page := range splitPages(data)[0:number] {
+    offset += len(page)
+  }
+  page := splitPages(data)[number]
+  corrupt[offset+len(page)-1] ^= 0x10
+  return corrupt
+}
+
+// readAllPackets reads packets until there is an error
+func readAllPackets(pr *ogg.PacketReader) ([][]byte, error) {
+  var packets [][]byte
+  for {
+    packet, err := pr.ReadPacket()
+    if err != nil {
+      return packets, err
+    }
+    packets = append(packets, packet.Data)
+  }
+}
+
+// isSubsequence returns true if every packet in sub appears in packets, in
+// the same order.
+func isSubsequence(sub, packets [][]byte) bool {
+  for _, packet := range packets {
+    if len(sub) > 0 && bytes.Equal(sub[0], packet) {
+      sub = sub[1:]
+    }
+  }
+  return len(sub) == 0
+}
+
+func CRCSpec(c gospec.Context) {
+  original, err := ioutil.ReadFile("metroid.ogg")
+  c.Assume(err, Equals, nil)
+  data := corruptPage(original, 5)
+
+  c.Specify("A page that fails its CRC gives a CRCError", func() {
+    pages := splitPages(data)
+    page, err := ogg.DecodePage(bytes.NewReader(pages[5]))
+    crc_err, ok := err.(*ogg.CRCError)
+    c.Assume(ok, IsTrue)
+    c.Expect(crc_err.Sequence, Equals, uint32(5))
+    c.Expect(crc_err.Serial, Equals, uint32(1160424692))
+    c.Expect(crc_err.Expected, Equals, page.Crc_checksum)
+    c.Expect(crc_err.Actual, Not(Equals), crc_err.Expected)
+    c.Expect(len(page.Data) > 0, IsTrue)
+
+    _, err = ogg.DecodePage(bytes.NewReader(splitPages(original)[5]))
+    c.Expect(err, Equals, nil)
+  })
+
+  c.Specify("Corrupt pages stop decoding by default", func() {
+    _, err := readAllPackets(ogg.NewPacketReader(bytes.NewReader(data)))
+    _, ok := err.(*ogg.CRCError)
+    c.Expect(ok, IsTrue)
+    c.Expect(ogg.Decode(bytes.NewReader(data)), Not(Equals), nil)
+  })
+
+  c.Specify("Corrupt pages can be reported and skipped", func() {
+    var skipped []uint32
+    options := ogg.Options{
+      Skip_corrupt_pages: true,
+      Corrupt_page: func(page ogg.Page, err *ogg.CRCError) {
+        skipped = append(skipped, page.Page_sequence_number)
+      },
+    }
+    packets, err := readAllPackets(ogg.NewPacketReaderWithOptions(bytes.NewReader(data), options))
+    c.Expect(err, Equals, io.EOF)
+    c.Expect(skipped, Equals, []uint32{5})
+    all, _ := readAllPackets(ogg.NewPacketReader(bytes.NewReader(original)))
+    c.Expect(len(packets) < len(all), IsTrue)
+    c.Expect(isSubsequence(packets, all), IsTrue)
+  })
+
+  c.Specify("Packets that span a skipped page are dropped", func() {
+    out := bytes.NewBuffer(nil)
+    w := ogg.NewWriter(out, 1)
+    w.Page_size = 300
+    var written [][]byte
+    for i := 0; i < 20; i++ {
+      packet := bytes.Repeat([]byte{byte(i)}, 100+97*i)
+      written = append(written, packet)
+      w.WritePacket(packet, uint64(i))
+    }
+    w.Close()
+    for _, number := range []int{1, 4, 9} {
+      options := ogg.Options{Skip_corrupt_pages: true}
+      pr := ogg.NewPacketReaderWithOptions(bytes.NewReader(corruptPage(out.Bytes(), number)), options)
+      packets, err := readAllPackets(pr)
+      c.Expect(err, Equals, io.EOF)
+      c.Expect(len(packets) < len(written), IsTrue)
+      c.Expect(isSubsequence(packets, written), IsTrue)
+    }
+  })
+
+  c.Specify("The vorbis decoder can skip corrupt pages", func() {
+    _, err := vorbis.NewDecoder(bytes.NewReader(corruptPage(original, 1)))
+    _, ok := err.(*ogg.CRCError)
+    c.Expect(ok, IsTrue)
+
+    d, err := vorbis.NewDecoderWithOptions(bytes.NewReader(data), ogg.Options{Skip_corrupt_pages: true})
+    c.Assume(err, Equals, nil)
+    buffer := make([]float32, 4096)
+    for err == nil {
+      _, err = d.ReadFloat32(buffer)
+    }
+    c.Expect(err, Equals, io.EOF)
+  })
+}
+
+// readAllPages reads pages until there is an error
+func readAllPages(pr *ogg.PageReader) ([]ogg.Page, error) {
+  var pages []ogg.Page
+  for {
+    page, err := pr.ReadPage()
+    if err != nil {
+      return pages, err
+    }
+    pages = append(pages, page)
+  }
+}
+
+func ResyncSpec(c gospec.Context) {
+  original, err := ioutil.ReadFile("metroid.ogg")
+  c.Assume(err, Equals, nil)
+  pages := splitPages(original)
+  junk := []byte("ID3\x03\x00\x00\x00\x00\x10\x00 some tag data OggS that isn't a page, Ogg")
+
+  join := func(parts ...[]byte) []byte {
+    return bytes.Join(parts, nil)
+  }
+
+  c.Specify("Junk before the first page is skipped", func() {
+    var reported []int
+    pr := ogg.NewPageReader(bytes.NewReader(join(junk, original)), ogg.Options{
+      Resync: func(skipped int) { reported = append(reported, skipped) },
+    })
+    read, err := readAllPages(pr)
+    c.Expect(err, Equals, io.EOF)
+    c.Expect(len(read), Equals, len(pages))
+    c.Expect(reported, Equals, []int{len(junk)})
+    c.Expect(pr.Skipped(), Equals, int64(len(junk)))
+  })
+
+  c.Specify("Junk between pages is skipped", func() {
+    data := join(join(pages[0:6]...), junk, junk, join(pages[6:]...))
+    pr := ogg.NewPageReader(bytes.NewReader(data), ogg.Options{})
+    read, err := readAllPages(pr)
+    c.Expect(err, Equals, io.EOF)
+    c.Assume(len(read), Equals, len(pages))
+    for i := range read {
+      c.Expect(read[i].Page_sequence_number, Equals, uint32(i))
+    }
+    c.Expect(pr.Skipped(), Equals, int64(2*len(junk)))
+  })
+
+  c.Specify("Junk after the last page is skipped", func() {
+    pr := ogg.NewPageReader(bytes.NewReader(join(original, junk[0:3])), ogg.Options{})
+    read, err := readAllPages(pr)
+    c.Expect(err, Equals, io.EOF)
+    c.Expect(len(read), Equals, len(pages))
+    c.Expect(pr.Skipped(), Equals, int64(3))
+  })
+
+  c.Specify("Reading can start in the middle of a page", func() {
+    start := len(pages[0]) + 100
+    pr := ogg.NewPageReader(bytes.NewReader(original[start:]), ogg.Options{})
+    read, err := readAllPages(pr)
+    c.Expect(err, Equals, io.EOF)
+    c.Assume(len(read), Equals, len(pages)-2)
+    c.Expect(read[0].Page_sequence_number, Equals, uint32(2))
+    c.Expect(pr.Skipped(), Equals, int64(len(pages[1])-100))
+  })
+
+  c.Specify("A damaged lacing value doesn't take the next page with it", func() {
+    // Making a lacing value of page 10 bigger makes the page look like it
+    // runs into page 11.
+    damaged := join(pages...)
+    lacing := len(join(pages[0:10]...)) + 27
+    for damaged[lacing] == 255 {
+      lacing++
+    }
+    damaged[lacing] = 255
+
+    var corrupt []uint32
+    pr := ogg.NewPageReader(bytes.NewReader(damaged), ogg.Options{
+      Skip_corrupt_pages: true,
+      Corrupt_page: func(page ogg.Page, err *ogg.CRCError) {
+        corrupt = append(corrupt, err.Sequence)
+      },
+    })
+    read, err := readAllPages(pr)
+    c.Expect(err, Equals, io.EOF)
+    c.Expect(corrupt, Equals, []uint32{10})
+    c.Assume(len(read), Equals, len(pages)-1)
+    c.Expect(read[10].Page_sequence_number, Equals, uint32(11))
+    c.Expect(pr.Skipped(), Equals, int64(len(pages[10])))
+
+    granule, err := ogg.LastGranule(bytes.NewReader(damaged), read[0].Bitstream_serial_number)
+    c.Expect(err, Equals, nil)
+    c.Expect(granule, Equals, uint64(185472))
+    page, err := ogg.SeekGranule(bytes.NewReader(damaged), read[0].Bitstream_serial_number, read[10].Granule_position)
+    c.Expect(err, Equals, nil)
+    c.Expect(page.Page_sequence_number, Equals, uint32(11))
+  })
+
+  c.Specify("A truncated last page is an unexpected EOF", func() {
+    pr := ogg.NewPageReader(bytes.NewReader(original[0:len(original)-10]), ogg.Options{})
+    read, err := readAllPages(pr)
+    c.Expect(errors.Is(err, io.ErrUnexpectedEOF), IsTrue)
+    c.Expect(len(read), Equals, len(pages)-1)
+  })
+
+  c.Specify("A file with a tag in front of it decodes the same as without", func() {
+    clean, err := vorbis.NewDecoder(bytes.NewReader(original))
+    c.Assume(err, Equals, nil)
+    tagged, err := vorbis.NewDecoder(bytes.NewReader(join(junk, original)))
+    c.Assume(err, Equals, nil)
+    a := make([]float32, 4096)
+    b := make([]float32, 4096)
+    for {
+      n, err := clean.ReadFloat32(a)
+      m, err2 := tagged.ReadFloat32(b)
+      c.Assume(m, Equals, n)
+      c.Assume(err2, Equals, err)
+      if err != nil {
+        break
+      }
+      c.Expect(b[0:m], Equals, a[0:n])
+    }
+  })
+}
+
+// countingReadSeeker counts how many bytes are read through it
+type countingReadSeeker struct {
+  io.ReadSeeker
+  read int
+}
+
+func (r *countingReadSeeker) Read(p []byte) (int, error) {
+  n, err := r.ReadSeeker.Read(p)
+  r.read += n
+  return n, err
+}
+
+func SeekSpec(c gospec.Context) {
+  // Two bitstreams interleaved, with packets big enough that some pages have
+  // no packets ending on them.
+  rng := rand.New(rand.NewSource(11))
+  out := bytes.NewBuffer(nil)
+  a := ogg.NewWriter(out, 0xaaaa)
+  b := ogg.NewWriter(out, 0xbbbb)
+  a.Page_size = 500
+  b.Page_size = 700
+  for i := 0; i < 400; i++ {
+    a.WritePacket(make([]byte, rng.Intn(2000)), uint64(1000*i))
+    b.WritePacket(make([]byte, rng.Intn(2000)), uint64(7*i))
+  }
+  a.Close()
+  b.Close()
+  data := out.Bytes()
+
+  // The expected result is found by reading every page
+  type pageInfo struct {
+    offset int64
+    page   ogg.Page
+  }
+  var pages []pageInfo
+  offset := int64(0)
+  for _, raw := range splitPages(data) {
+    page, err := ogg.DecodePage(bytes.NewReader(raw))
+    c.Assume(err, Equals, nil)
+    pages = append(pages, pageInfo{offset, page})
+    offset += int64(len(raw))
+  }
+  expected := func(serial uint32, granule uint64) (pageInfo, bool) {
+    for _, p := range pages {
+      if p.page.Bitstream_serial_number == serial && p.page.Granule_position != ogg.NoGranulePosition && p.page.Granule_position >= granule {
+        return p, true
+      }
+    }
+    return pageInfo{}, false
+  }
+
+  c.Specify("Seeking finds the same page as reading every page", func() {
+    c.Assume(len(data) > 500000, IsTrue)
+    unended := 0
+    for _, p := range pages {
+      if p.page.Granule_position == ogg.NoGranulePosition {
+        unended++
+      }
+    }
+    c.Assume(unended > 10, IsTrue)
+
+    for i := 0; i < 200; i++ {
+      serial, granule := uint32(0xaaaa), uint64(rng.Intn(400000))
+      if i%2 == 1 {
+        serial, granule = 0xbbbb, uint64(rng.Intn(2800))
+      }
+      if i < 4 {
+        granule = 0
+      }
+      want, ok := expected(serial, granule)
+      c.Assume(ok, IsTrue)
+      rs := bytes.NewReader(data)
+      page, err := ogg.SeekGranule(rs, serial, granule)
+      c.Expect(err, Equals, nil)
+      c.Expect(page.Bitstream_serial_number, Equals, serial)
+      c.Expect(page.Page_sequence_number, Equals, want.page.Page_sequence_number)
+      position, _ := rs.Seek(0, 1)
+      c.Expect(position, Equals, want.offset)
+    }
+  })
+
+  c.Specify("Seeking doesn't read the whole file", func() {
+    rs := &countingReadSeeker{bytes.NewReader(data), 0}
+    _, err := ogg.SeekGranule(rs, 0xaaaa, 250000)
+    c.Expect(err, Equals, nil)
+    c.Expect(rs.read < len(data)/2, IsTrue)
+  })
+
+  c.Specify("Seeking keeps bisecting after landing exactly on a page", func() {
+    // 4096 pages of exactly the same size, so the first middle is the start
+    // of a page.
+    out := bytes.NewBuffer(nil)
+    w := ogg.NewWriter(out, 0xcccc)
+    for i := 0; i < 4096; i++ {
+      w.WritePacket(make([]byte, 1000), uint64(i))
+      if i < 4095 {
+        w.Flush()
+      }
+    }
+    w.Close()
+    rs := &countingReadSeeker{bytes.NewReader(out.Bytes()), 0}
+    page, err := ogg.SeekGranule(rs, 0xcccc, 2000)
+    c.Expect(err, Equals, nil)
+    c.Expect(page.Granule_position, Equals, uint64(2000))
+    c.Expect(rs.read < out.Len()/8, IsTrue)
+  })
+
+  c.Specify("Seeking past the end of a bitstream is an EOF", func() {
+    _, err := ogg.SeekGranule(bytes.NewReader(data), 0xaaaa, 400000)
+    c.Expect(err, Equals, io.EOF)
+    _, err = ogg.SeekGranule(bytes.NewReader(data), 0xcccc, 0)
+    c.Expect(err, Equals, io.EOF)
+  })
+
+  c.Specify("Seeking in a small file", func() {
+    original, err := ioutil.ReadFile("metroid.ogg")
+    c.Assume(err, Equals, nil)
+    rs := bytes.NewReader(original)
+    page, err := ogg.SeekGranule(rs, 1160424692, 100000)
+    c.Assume(err, Equals, nil)
+    c.Expect(page.Granule_position >= 100000, IsTrue)
+    position, _ := rs.Seek(0, 1)
+    next, err := ogg.DecodePage(rs)
+    c.Expect(err, Equals, nil)
+    c.Expect(next.Page_sequence_number, Equals, page.Page_sequence_number)
+    c.Expect(position > 0, IsTrue)
+  })
+}
+
+// decodeAll reads every sample from a decoder
+func decodeAll(d *vorbis.Decoder) ([]float32, error) {
+  var samples []float32
+  buffer := make([]float32, 4096)
+  for {
+    n, err := d.ReadFloat32(buffer)
+    samples = append(samples, buffer[0:n]...)
+    if err == io.EOF {
+      return samples, nil
+    }
+    if err != nil {
+      return samples, err
+    }
+  }
+}
+
+func DecoderSeekSpec(c gospec.Context) {
+  original, err := ioutil.ReadFile("metroid.ogg")
+  c.Assume(err, Equals, nil)
+  d, err := vorbis.NewDecoder(bytes.NewReader(original))
+  c.Assume(err, Equals, nil)
+  linear, err := decodeAll(d)
+  c.Assume(err, Equals, nil)
+  frames := int64(len(linear) / 2)
+
+  // A file that's big enough to need bisecting, made by repeating the audio
+  // packets of metroid.ogg
+  pr := ogg.NewPacketReader(bytes.NewReader(original))
+  var packets [][]byte
+  for {
+    packet, err := pr.ReadPacket()
+    if err != nil {
+      break
+    }
+    packets = append(packets, packet.Data)
+  }
+  long := bytes.NewBuffer(nil)
+  w := ogg.NewWriter(long, 5)
+  for i, packet := range packets[0:3] {
+    w.WritePacket(packet, 0)
+    if i == 0 || i == 2 {
+      w.Flush()
+    }
+  }
+  // Positions are counted the same way the decoder counts them, so the
+  // first audio packet ends at 0.
+  var position int64
+  previous := 0
+  for repeat := 0; repeat < 8; repeat++ {
+    for _, packet := range packets[3:] {
+      blocksize := 256
+      if packet[0]&2 != 0 {
+        blocksize = 2048
+      }
+      if previous != 0 {
+        position += int64(previous/4 + blocksize/4)
+      }
+      previous = blocksize
+      w.WritePacket(packet, uint64(position))
+    }
+  }
+  w.Close()
+
+  targets := []int64{0, 1, 127, 128, 1000, 4095, 50000, 100001, frames - 1000, frames - 1}
+  for _, target := range targets {
+    c.Specify(fmt.Sprintf("Seeking to %d gives the same samples as linear decoding", target), func() {
+      d, err := vorbis.NewDecoder(bytes.NewReader(original))
+      c.Assume(err, Equals, nil)
+      position, err := d.Seek(target, 0)
+      c.Assume(err, Equals, nil)
+      c.Expect(position, Equals, target)
+      samples, err := decodeAll(d)
+      c.Assume(err, Equals, nil)
+      c.Expect(len(samples), Equals, len(linear)-int(2*target))
+      same := true
+      for i := range samples {
+        same = same && samples[i] == linear[int(2*target)+i]
+      }
+      c.Expect(same, IsTrue)
+    })
+  }
+
+  c.Specify("Seeking in a long file gives the same samples as linear decoding", func() {
+    d, err := vorbis.NewDecoder(bytes.NewReader(long.Bytes()))
+    c.Assume(err, Equals, nil)
+    all, err := decodeAll(d)
+    c.Assume(err, Equals, nil)
+    c.Assume(len(long.Bytes()) > 500000, IsTrue)
+
+    rng := rand.New(rand.NewSource(2))
+    for i := 0; i < 20; i++ {
+      target := rng.Int63n(int64(len(all) / 2))
+      _, err := d.Seek(target, 0)
+      c.Assume(err, Equals, nil)
+      buffer := make([]float32, 2000)
+      n, err := d.ReadFloat32(buffer)
+      c.Assume(err, Equals, nil)
+      same := true
+      for j := range buffer[0:n] {
+        same = same && buffer[j] == all[int(2*target)+j]
+      }
+      c.Expect(same, IsTrue)
+    }
+  })
+
+  c.Specify("Seeking past the end gives EOF", func() {
+    d, err := vorbis.NewDecoder(bytes.NewReader(original))
+    c.Assume(err, Equals, nil)
+    _, err = d.Seek(frames, 0)
+    c.Expect(err, Equals, nil)
+    _, err = d.ReadFloat32(make([]float32, 100))
+    c.Expect(err, Equals, io.EOF)
+    _, err = d.Seek(frames+1000000, 0)
+    c.Expect(err, Equals, nil)
+    _, err = d.ReadFloat32(make([]float32, 100))
+    c.Expect(err, Equals, io.EOF)
+
+    // And seeking back again works
+    _, err = d.Seek(10, 0)
+    c.Expect(err, Equals, nil)
+    samples, _ := decodeAll(d)
+    c.Expect(len(samples), Equals, len(linear)-20)
+  })
+
+  c.Specify("Seeking needs an io.ReadSeeker", func() {
+    d, err := vorbis.NewDecoder(bytes.NewBuffer(original))
+    c.Assume(err, Equals, nil)
+    _, err = d.Seek(10, 0)
+    c.Expect(err, Not(Equals), nil)
+  })
+
+  c.Specify("Seeking relative to the current position", func() {
+    d, err := vorbis.NewDecoder(bytes.NewReader(original))
+    c.Assume(err, Equals, nil)
+    _, err = d.ReadFloat32(make([]float32, 2000))
+    c.Assume(err, Equals, nil)
+    position, err := d.Seek(-500, 1)
+    c.Assume(err, Equals, nil)
+    c.Expect(position, Equals, int64(500))
+    buffer := make([]float32, 100)
+    n, _ := d.ReadFloat32(buffer)
+    c.Expect(buffer[0:n], Equals, linear[1000:1000+n])
+    position, _ = d.Seek(0, 1)
+    c.Expect(position, Equals, int64(550))
+  })
+
+  c.Specify("Seeking relative to the end of the stream", func() {
+    d, err := vorbis.NewDecoder(bytes.NewReader(original))
+    c.Assume(err, Equals, nil)
+    position, err := d.Seek(-1000, 2)
+    c.Assume(err, Equals, nil)
+    c.Expect(position, Equals, frames-1000)
+    samples, err := decodeAll(d)
+    c.Assume(err, Equals, nil)
+    c.Expect(samples, Equals, linear[len(linear)-2000:])
+    position, err = d.Seek(0, 2)
+    c.Assume(err, Equals, nil)
+    c.Expect(position, Equals, frames)
+    _, err = d.ReadFloat32(make([]float32, 100))
+    c.Expect(err, Equals, io.EOF)
+  })
+}
+
+// readerOnly hides any other methods of the reader it wraps, so that it
+// can't be used as an io.ReadSeeker.
+type readerOnly struct {
+  io.Reader
+}
+
+func LengthSpec(c gospec.Context) {
+  original, err := ioutil.ReadFile("metroid.ogg")
+  c.Assume(err, Equals, nil)
+  seconds := 185472.0 / 44100
+
+  c.Specify("The last granule position is found", func() {
+    granule, err := ogg.LastGranule(bytes.NewReader(original), 1160424692)
+    c.Expect(err, Equals, nil)
+    c.Expect(granule, Equals, uint64(185472))
+  })
+
+  c.Specify("The last granule position of each interleaved bitstream is found from the end of the file", func() {
+    out := bytes.NewBuffer(nil)
+    a := ogg.NewWriter(out, 0xaaaa)
+    b := ogg.NewWriter(out, 0xbbbb)
+    a.Page_size = 500
+    b.Page_size = 700
+    for i := 0; i < 4000; i++ {
+      a.WritePacket(make([]byte, 300), uint64(1000*i))
+      b.WritePacket(make([]byte, 200), uint64(7*i))
+    }
+    a.Close()
+    b.Close()
+    rs := &countingReadSeeker{bytes.NewReader(out.Bytes()), 0}
+    granule, err := ogg.LastGranule(rs, 0xaaaa)
+    c.Expect(err, Equals, nil)
+    c.Expect(granule, Equals, uint64(3999000))
+    c.Expect(rs.read < out.Len()/2, IsTrue)
+    granule, err = ogg.LastGranule(bytes.NewReader(out.Bytes()), 0xbbbb)
+    c.Expect(err, Equals, nil)
+    c.Expect(granule, Equals, uint64(27993))
+    _, err = ogg.LastGranule(bytes.NewReader(out.Bytes()), 0xcccc)
+    c.Expect(err, Equals, io.EOF)
+  })
+
+  c.Specify("The length of a seekable file is read from its first and last pages", func() {
+    length, err := vorbis.ReadLength(bytes.NewReader(original))
+    c.Assume(err, Equals, nil)
+    c.Expect(length.Samples, Equals, int64(185472))
+    c.Expect(length.Seconds, IsWithin(1e-9), seconds)
+    c.Expect(length.Bitrate, IsWithin(1e-6), float64(len(original)*8)/seconds)
+  })
+
+  c.Specify("The length of a stream that can't seek is the same", func() {
+    length, err := vorbis.ReadLength(readerOnly{bytes.NewReader(original)})
+    c.Assume(err, Equals, nil)
+    c.Expect(length.Samples, Equals, int64(185472))
+    c.Expect(length.Seconds, IsWithin(1e-9), seconds)
+    c.Expect(length.Bitrate, IsWithin(1e-6), float64(len(original)*8)/seconds)
+  })
+
+  c.Specify("A stream that doesn't start at 0 is measured from its first sample", func() {
+    pr := ogg.NewPacketReader(bytes.NewReader(original))
+    out := bytes.NewBuffer(nil)
+    w := ogg.NewWriter(out, 5)
+    for i := 0; ; i++ {
+      packet, err := pr.ReadPacket()
+      if err != nil {
+        break
+      }
+      granule := packet.Granule_position
+      if i >= 3 && granule != ogg.NoGranulePosition {
+        granule += 100000
+      }
+      w.WritePacket(packet.Data, granule)
+      if i == 0 || i == 2 {
+        w.Flush()
+      }
+    }
+    w.Close()
+    for _, in := range []io.Reader{bytes.NewReader(out.Bytes()), readerOnly{bytes.NewReader(out.Bytes())}} {
+      length, err := vorbis.ReadLength(in)
+      c.Assume(err, Equals, nil)
+      c.Expect(length.Samples, Equals, int64(185472))
+    }
+  })
+
+  c.Specify("A file that ends during the headers is an error", func() {
+    _, err := vorbis.ReadLength(bytes.NewReader(original[0:3000]))
+    c.Expect(errors.Is(err, io.ErrUnexpectedEOF), IsTrue)
+  })
+}
+
+// repackStream writes the packets of an Ogg file out again as a bitstream
+// with a different serial number.  If sample_rate isn't 0 it replaces the
+// sample rate in the Vorbis id header.
+func repackStream(original []byte, serial uint32, sample_rate uint32) []byte {
+  pr := ogg.NewPacketReader(bytes.NewReader(original))
+  out := bytes.NewBuffer(nil)
+  w := ogg.NewWriter(out, serial)
+  for i := 0; ; i++ {
+    packet, err := pr.ReadPacket()
+    if err != nil {
+      break
+    }
+    data := packet.Data
+    if i == 0 && sample_rate != 0 {
+      data = append([]byte(nil), data...)
+      data[12] = byte(sample_rate)
+      data[13] = byte(sample_rate >> 8)
+      data[14] = byte(sample_rate >> 16)
+      data[15] = byte(sample_rate >> 24)
+    }
+    w.WritePacket(data, packet.Granule_position)
+    if i == 0 || i == 2 {
+      w.Flush()
+    }
+  }
+  w.Close()
+  return out.Bytes()
+}
+
+// decodeLinks decodes data and returns the links passed to each of the
+// callbacks in Options.
+func decodeLinks(data []byte) (links, ended []ogg.Link, changes [][2]ogg.Link, err error) {
+  options := ogg.Options{
+    Link: func(link ogg.Link) {
+      links = append(links, link)
+    },
+    Link_end: func(link ogg.Link) {
+      ended = append(ended, link)
+    },
+    Format_change: func(previous, link ogg.Link) {
+      changes = append(changes, [2]ogg.Link{previous, link})
+    },
+  }
+  err = ogg.DecodeWithOptions(bytes.NewReader(data), options)
+  return
+}
+
+// multiplex interleaves the packets of several Ogg files into one, a packet
+// from each in turn.  The first pages of every bitstream come first.
+func multiplex(files ...[]byte) []byte {
+  out := bytes.NewBuffer(nil)
+  readers := make([]*ogg.PacketReader, len(files))
+  writers := make([]*ogg.Writer, len(files))
+  for i := range files {
+    readers[i] = ogg.NewPacketReader(bytes.NewReader(files[i]))
+  }
+  for done := 0; done < len(files); {
+    for i := range readers {
+      if readers[i] == nil {
+        continue
+      }
+      packet, err := readers[i].ReadPacket()
+      if err != nil {
+        writers[i].Close()
+        readers[i] = nil
+        done++
+        continue
+      }
+      if writers[i] == nil {
+        writers[i] = ogg.NewWriter(out, readers[i].Serial())
+        writers[i].WritePacket(packet.Data, packet.Granule_position)
+        writers[i].Flush()
+        continue
+      }
+      writers[i].WritePacket(packet.Data, packet.Granule_position)
+    }
+  }
+  return out.Bytes()
+}
+
+func ChainSpec(c gospec.Context) {
+  original, err := ioutil.ReadFile("metroid.ogg")
+  c.Assume(err, Equals, nil)
+
+  c.Specify("A plain file is a single link", func() {
+    links, ended, changes, err := decodeLinks(original)
+    c.Assume(err, Equals, nil)
+    c.Assume(len(links), Equals, 1)
+    c.Assume(len(ended), Equals, 1)
+    c.Expect(links[0].Index, Equals, 0)
+    c.Expect(links[0].Offset, Equals, int64(0))
+    c.Expect(ended[0].End, Equals, int64(len(original)))
+    c.Assume(len(links[0].Streams), Equals, 1)
+    stream := links[0].Streams[0]
+    c.Expect(stream.Serial, Equals, uint32(1160424692))
+    c.Expect(stream.Parameters, Equals, ogg.Parameters{Channels: 2, Sample_rate: 44100})
+    c.Expect(len(stream.Headers), Equals, 3)
+    c.Expect(len(changes), Equals, 0)
+  })
+
+  c.Specify("Each link of a chained file is reported in order", func() {
+    // The second link reuses the serial number of the first, which is
+    // allowed once the first has ended.
+    parts := [][]byte{
+      original,
+      repackStream(original, 1160424692, 0),
+      repackStream(original, 7, 22050),
+    }
+    chained := bytes.Join(parts, nil)
+    links, ended, changes, err := decodeLinks(chained)
+    c.Assume(err, Equals, nil)
+    c.Assume(len(links), Equals, 3)
+    c.Assume(len(ended), Equals, 3)
+    offset := int64(0)
+    for i := range links {
+      c.Expect(links[i].Index, Equals, i)
+      c.Expect(links[i].Offset, Equals, offset)
+      c.Expect(ended[i].End, Equals, offset+int64(len(parts[i])))
+      c.Expect(len(links[i].Streams), Equals, 1)
+      c.Expect(len(links[i].Streams[0].Headers), Equals, 3)
+      offset += int64(len(parts[i]))
+    }
+    c.Expect(links[1].Streams[0].Serial, Equals, uint32(1160424692))
+    c.Expect(links[2].Streams[0].Serial, Equals, uint32(7))
+    c.Expect(links[2].Parameters(), Equals, ogg.Parameters{Channels: 2, Sample_rate: 22050})
+
+    c.Assume(len(changes), Equals, 1)
+    c.Expect(changes[0][0].Index, Equals, 1)
+    c.Expect(changes[0][1].Index, Equals, 2)
+    c.Expect(changes[0][0].Parameters().Sample_rate, Equals, 44100)
+    c.Expect(changes[0][1].Parameters().Sample_rate, Equals, 22050)
+  })
+
+  c.Specify("Multiplexed bitstreams that start together are in the same link", func() {
+    out := multiplex(repackStream(original, 1, 0), repackStream(original, 2, 0))
+    links, ended, _, err := decodeLinks(out)
+    c.Assume(err, Equals, nil)
+    c.Assume(len(links), Equals, 1)
+    c.Assume(len(links[0].Streams), Equals, 2)
+    c.Expect(links[0].Streams[0].Serial, Equals, uint32(1))
+    c.Expect(links[0].Streams[1].Serial, Equals, uint32(2))
+    for _, stream := range links[0].Streams {
+      c.Expect(len(stream.Headers), Equals, 3)
+    }
+    c.Expect(len(ended), Equals, 1)
+  })
+}
+
+func DemuxSpec(c gospec.Context) {
+  original, err := ioutil.ReadFile("metroid.ogg")
+  c.Assume(err, Equals, nil)
+  a := repackStream(original, 1, 0)
+  b := repackStream(original, 2, 22050)
+  data := multiplex(a, b)
+  expected := map[uint32][][]byte{1: nil, 2: nil}
+  for serial, file := range map[uint32][]byte{1: a, 2: b} {
+    pr := ogg.NewPacketReader(bytes.NewReader(file))
+    for {
+      packet, err := pr.ReadPacket()
+      if err != nil {
+        break
+      }
+      expected[serial] = append(expected[serial], packet.Data)
+    }
+  }
+
+  // readAll reads every packet from a Demuxer, sorted by bitstream
+  readAll := func(d *ogg.Demuxer) (map[uint32][][]byte, error) {
+    packets := make(map[uint32][][]byte)
+    for {
+      serial, packet, err := d.ReadPacket()
+      if err == io.EOF {
+        return packets, nil
+      }
+      if err != nil {
+        return packets, err
+      }
+      packets[serial] = append(packets[serial], packet.Data)
+    }
+  }
+
+  c.Specify("Every bitstream is reported as it starts", func() {
+    var seen []ogg.Bitstream
+    d := ogg.NewDemuxer(bytes.NewReader(data), ogg.Options{}, func(stream ogg.Bitstream) bool {
+      seen = append(seen, stream)
+      return true
+    })
+    _, _, err := d.ReadPacket()
+    c.Assume(err, Equals, nil)
+    c.Assume(len(seen), Equals, 1)
+    c.Expect(seen[0].Serial, Equals, uint32(1))
+    c.Expect(seen[0].Format, Equals, "\x01vorbis")
+    c.Expect(string(seen[0].First), Equals, string(expected[1][0]))
+
+    _, err = readAll(d)
+    c.Assume(err, Equals, nil)
+    c.Assume(len(seen), Equals, 2)
+    c.Expect(seen[1].Serial, Equals, uint32(2))
+    c.Expect(string(seen[1].First), Equals, string(expected[2][0]))
+    c.Expect(len(d.Bitstreams()), Equals, 2)
+  })
+
+  c.Specify("Every packet of every bitstream is returned by default", func() {
+    packets, err := readAll(ogg.NewDemuxer(bytes.NewReader(data), ogg.Options{}, nil))
+    c.Assume(err, Equals, nil)
+    for serial := range expected {
+      c.Assume(len(packets[serial]), Equals, len(expected[serial]))
+      for i := range expected[serial] {
+        c.Expect(string(packets[serial][i]), Equals, string(expected[serial][i]))
+      }
+    }
+  })
+
+  c.Specify("Only the packets of picked bitstreams are returned", func() {
+    d := ogg.NewDemuxer(bytes.NewReader(data), ogg.Options{}, func(stream ogg.Bitstream) bool {
+      return stream.Serial == 2
+    })
+    packets, err := readAll(d)
+    c.Assume(err, Equals, nil)
+    c.Expect(len(packets[1]), Equals, 0)
+    c.Assume(len(packets[2]), Equals, len(expected[2]))
+    for i := range expected[2] {
+      c.Expect(string(packets[2][i]), Equals, string(expected[2][i]))
+    }
+  })
+
+  c.Specify("A dropped bitstream that is picked again carries on with whole packets", func() {
+    d := ogg.NewDemuxer(bytes.NewReader(data), ogg.Options{}, nil)
+    packets := make(map[uint32][][]byte)
+    for i := 0; ; i++ {
+      if i == 50 {
+        d.Select(1, false)
+      }
+      if i == 100 {
+        d.Select(1, true)
+      }
+      serial, packet, err := d.ReadPacket()
+      if err == io.EOF {
+        break
+      }
+      c.Assume(err, Equals, nil)
+      packets[serial] = append(packets[serial], packet.Data)
+    }
+    c.Expect(len(packets[2]), Equals, len(expected[2]))
+    c.Expect(len(packets[1]) < len(expected[1]), IsTrue)
+    c.Expect(isSubsequence(packets[1], expected[1]), IsTrue)
+  })
+
+  c.Specify("Input that ends part way through a bitstream is unexpected", func() {
+    _, err := readAll(ogg.NewDemuxer(bytes.NewReader(data[0:len(data)/2]), ogg.Options{}, nil))
+    c.Expect(errors.Is(err, io.ErrUnexpectedEOF), IsTrue)
+  })
+}
+
+// fakeVideo returns a bitstream that isn't Vorbis, standing in for the video
+// that comes first in a Theora file.
+func fakeVideo(serial uint32) []byte {
+  out := bytes.NewBuffer(nil)
+  w := ogg.NewWriter(out, serial)
+  w.WritePacket([]byte("\x80theora and the rest of its header"), 0)
+  w.Flush()
+  for i := 1; i < 200; i++ {
+    w.WritePacket(bytes.Repeat([]byte{byte(i)}, 500), uint64(i))
+  }
+  w.Close()
+  return out.Bytes()
+}
+
+func VorbisSelectionSpec(c gospec.Context) {
+  original, err := ioutil.ReadFile("metroid.ogg")
+  c.Assume(err, Equals, nil)
+  d, err := vorbis.NewDecoder(bytes.NewReader(original))
+  c.Assume(err, Equals, nil)
+  linear, err := decodeAll(d)
+  c.Assume(err, Equals, nil)
+  data := multiplex(fakeVideo(7), original)
+
+  c.Specify("Bitstreams before the first Vorbis stream are skipped", func() {
+    c.Assume(ogg.Decode(bytes.NewReader(data)), Equals, nil)
+    d, err := vorbis.NewDecoder(bytes.NewReader(data))
+    c.Assume(err, Equals, nil)
+    samples, err := decodeAll(d)
+    c.Assume(err, Equals, nil)
+    c.Expect(samples, Equals, linear)
+  })
+
+  c.Specify("Seeking stays in the Vorbis stream", func() {
+    d, err := vorbis.NewDecoder(bytes.NewReader(data))
+    c.Assume(err, Equals, nil)
+    for _, target := range []int64{100000, 100} {
+      _, err = d.Seek(target, 0)
+      c.Assume(err, Equals, nil)
+      buffer := make([]float32, 200)
+      n, err := d.ReadFloat32(buffer)
+      c.Assume(err, Equals, nil)
+      c.Expect(buffer[0:n], Equals, linear[2*target:2*target+int64(n)])
+    }
+  })
+
+  c.Specify("The length is read from the Vorbis stream", func() {
+    for _, in := range []io.Reader{bytes.NewReader(data), readerOnly{bytes.NewReader(data)}} {
+      length, err := vorbis.ReadLength(in)
+      c.Assume(err, Equals, nil)
+      c.Expect(length.Samples, Equals, int64(185472))
+    }
+  })
+
+  c.Specify("A Vorbis stream can be picked by its serial number", func() {
+    tracks := multiplex(fakeVideo(7), repackStream(original, 1, 0), repackStream(original, 2, 22050))
+    d, err := vorbis.NewDecoderForSerial(bytes.NewReader(tracks), 2, ogg.Options{})
+    c.Assume(err, Equals, nil)
+    c.Expect(d.Info().Sample_rate, Equals, 22050)
+    samples, err := decodeAll(d)
+    c.Assume(err, Equals, nil)
+    c.Expect(samples, Equals, linear)
+    d, err = vorbis.NewDecoder(bytes.NewReader(tracks))
+    c.Assume(err, Equals, nil)
+    c.Expect(d.Info().Sample_rate, Equals, 44100)
+  })
+
+  c.Specify("A file without a Vorbis stream is reported", func() {
+    _, err := vorbis.NewDecoder(bytes.NewReader(fakeVideo(7)))
+    c.Expect(errors.Is(err, vorbis.ErrNotVorbis), IsTrue)
+    _, err = vorbis.ReadLength(bytes.NewReader(fakeVideo(7)))
+    c.Expect(errors.Is(err, vorbis.ErrNotVorbis), IsTrue)
+    _, err = vorbis.NewDecoderForSerial(bytes.NewReader(data), 12345, ogg.Options{})
+    c.Expect(errors.Is(err, vorbis.ErrNotVorbis), IsTrue)
+  })
+}
+
+func DecodeContextSpec(c gospec.Context) {
+  original, err := ioutil.ReadFile("metroid.ogg")
+  c.Assume(err, Equals, nil)
+
+  // rewrite repacks the packets of metroid.ogg, letting edit change or drop
+  // them by returning nil.
+  rewrite := func(edit func(i int, packet []byte) []byte) []byte {
+    pr := ogg.NewPacketReader(bytes.NewReader(original))
+    out := bytes.NewBuffer(nil)
+    w := ogg.NewWriter(out, 3)
+    for i := 0; ; i++ {
+      packet, err := pr.ReadPacket()
+      if err != nil {
+        break
+      }
+      if data := edit(i, packet.Data); data != nil {
+        w.WritePacket(data, packet.Granule_position)
+      }
+    }
+    w.Close()
+    return out.Bytes()
+  }
+
+  c.Specify("A bad setup header is returned as an error", func() {
+    data := rewrite(func(i int, packet []byte) []byte {
+      if i == 2 {
+        return packet[0:40]
+      }
+      return packet
+    })
+    c.Expect(ogg.Decode(bytes.NewReader(data)), Not(Equals), nil)
+  })
+
+  c.Specify("A stream that ends during its headers is an error", func() {
+    data := rewrite(func(i int, packet []byte) []byte {
+      if i < 2 {
+        return packet
+      }
+      return nil
+    })
+    err := ogg.Decode(bytes.NewReader(data))
+    c.Expect(errors.Is(err, vorbis.ErrTruncatedHeader), IsTrue)
+    var header_err *vorbis.HeaderError
+    c.Assume(errors.As(err, &header_err), IsTrue)
+    c.Expect(header_err.Header, Equals, "setup")
+  })
+
+  c.Specify("A cancelled context stops decoding", func() {
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+    c.Expect(ogg.DecodeContext(ctx, bytes.NewReader(original)), Equals, context.Canceled)
+  })
+
+  c.Specify("Decoding can be cancelled part way through", func() {
+    ctx, cancel := context.WithCancel(context.Background())
+    chained := bytes.Join([][]byte{original, repackStream(original, 7, 0)}, nil)
+    var links []ogg.Link
+    options := ogg.Options{
+      Link: func(link ogg.Link) {
+        links = append(links, link)
+        cancel()
+      },
+    }
+    err := ogg.DecodeContextWithOptions(ctx, bytes.NewReader(chained), options)
+    c.Expect(err, Equals, context.Canceled)
+    c.Expect(len(links), Equals, 1)
+  })
+}
+
+func ErrorsSpec(c gospec.Context) {
+  original, err := ioutil.ReadFile("metroid.ogg")
+  c.Assume(err, Equals, nil)
+  pages := splitPages(original)
+  offsets := make([]int64, len(pages))
+  for i := 1; i < len(pages); i++ {
+    offsets[i] = offsets[i-1] + int64(len(pages[i-1]))
+  }
+  // edit returns a copy of metroid.ogg with its pages replaced by the
+  // result of edit
+  edit := func(edit func(pages [][]byte) [][]byte) []byte {
+    copied := make([][]byte, len(pages))
+    for i := range pages {
+      copied[i] = append([]byte(nil), pages[i]...)
+    }
+    return bytes.Join(edit(copied), nil)
+  }
+
+  c.Specify("A page without a capture pattern is reported by DecodePage", func() {
+    data := append([]byte("Oggs"), pages[0][4:]...)
+    _, err := ogg.DecodePage(bytes.NewReader(data))
+    c.Expect(errors.Is(err, ogg.ErrCapturePattern), IsTrue)
+  })
+
+  c.Specify("A page with an unknown version is reported with its offset", func() {
+    data := edit(func(pages [][]byte) [][]byte {
+      pages[5][4] = 1
+      return pages
+    })
+    err := ogg.Decode(bytes.NewReader(data))
+    c.Expect(errors.Is(err, ogg.ErrVersion), IsTrue)
+    var page_err *ogg.PageError
+    c.Assume(errors.As(err, &page_err), IsTrue)
+    c.Expect(page_err.Offset, Equals, offsets[5])
+    c.Expect(page_err.Sequence, Equals, uint32(5))
+  })
+
+  c.Specify("A CRC failure is reported with its offset", func() {
+    err := ogg.Decode(bytes.NewReader(corruptPage(original, 7)))
+    c.Expect(errors.Is(err, ogg.ErrCRC), IsTrue)
+    var crc_err *ogg.CRCError
+    c.Assume(errors.As(err, &crc_err), IsTrue)
+    c.Expect(crc_err.Offset, Equals, offsets[7])
+    c.Expect(crc_err.Sequence, Equals, uint32(7))
+  })
+
+  c.Specify("A truncated page is reported with its offset", func() {
+    err := ogg.Decode(bytes.NewReader(original[0 : offsets[20]+100]))
+    c.Expect(errors.Is(err, ogg.ErrTruncatedPage), IsTrue)
+    var page_err *ogg.PageError
+    c.Assume(errors.As(err, &page_err), IsTrue)
+    c.Expect(page_err.Offset, Equals, offsets[20])
+    c.Expect(page_err.Sequence, Equals, uint32(20))
+    c.Expect(page_err.Serial, Equals, uint32(1160424692))
+  })
+
+  c.Specify("A bitstream that starts twice is reported unless damage is being skipped", func() {
+    data := edit(func(pages [][]byte) [][]byte {
+      return append(pages[0:3], append([][]byte{pages[0]}, pages[3:]...)...)
+    })
+    err := ogg.Decode(bytes.NewReader(data))
+    c.Expect(errors.Is(err, ogg.ErrDuplicateBOS), IsTrue)
+    var page_err *ogg.PageError
+    c.Assume(errors.As(err, &page_err), IsTrue)
+    c.Expect(page_err.Offset, Equals, offsets[3])
+    c.Expect(ogg.DecodeWithOptions(bytes.NewReader(data), ogg.Options{Skip_corrupt_pages: true}), Equals, nil)
+  })
+
+  c.Specify("A bitstream that never started is reported unless damage is being skipped", func() {
+    data := original[offsets[1]:]
+    err := ogg.Decode(bytes.NewReader(data))
+    c.Expect(errors.Is(err, ogg.ErrMissingBOS), IsTrue)
+    var page_err *ogg.PageError
+    c.Assume(errors.As(err, &page_err), IsTrue)
+    c.Expect(page_err.Offset, Equals, int64(0))
+    c.Expect(ogg.DecodeWithOptions(bytes.NewReader(data), ogg.Options{Skip_corrupt_pages: true}), Equals, nil)
+  })
+
+  c.Specify("Bitstreams that don't finish are listed", func() {
+    data := multiplex(repackStream(original, 1, 0), repackStream(original, 2, 0))
+    multiplexed := splitPages(data)
+    end := 0
+    for _, page := range multiplexed[0 : len(multiplexed)/2] {
+      end += len(page)
+    }
+    err := ogg.Decode(bytes.NewReader(data[0:end]))
+    c.Expect(errors.Is(err, ogg.ErrUnfinishedStreams), IsTrue)
+    c.Expect(errors.Is(err, io.ErrUnexpectedEOF), IsTrue)
+    var unfinished *ogg.UnfinishedError
+    c.Assume(errors.As(err, &unfinished), IsTrue)
+    c.Expect(unfinished.Serials, Equals, []uint32{1, 2})
+    c.Expect(unfinished.Offset, Equals, int64(end))
+  })
+}
+
+func VorbisHeaderErrorSpec(c gospec.Context) {
+  original, err := ioutil.ReadFile("metroid.ogg")
+  c.Assume(err, Equals, nil)
+  packets, err := readAllPackets(ogg.NewPacketReader(bytes.NewReader(original)))
+  c.Assume(err, Equals, io.EOF)
+  // rewrite returns metroid.ogg's headers and first few audio packets after
+  // edit has changed the setup header.
+  rewrite := func(edit func(setup []byte)) []byte {
+    setup := append([]byte(nil), packets[2]...)
+    edit(setup)
+    out := bytes.NewBuffer(nil)
+    w := ogg.NewWriter(out, 1)
+    for i, packet := range append([][]byte{packets[0], packets[1], setup}, packets[3:20]...) {
+      w.WritePacket(packet, uint64(i))
+      if i < 3 {
+        w.Flush()
+      }
+    }
+    w.Close()
+    return out.Bytes()
+  }
+
+  c.Specify("Damaged setup headers are reported through Decode", func() {
+    data := rewrite(func(setup []byte) {
+      // The sync pattern of the first codebook
+      setup[8] = 0
+    })
+    err := ogg.Decode(bytes.NewReader(data))
+    var header_err *vorbis.HeaderError
+    c.Assume(errors.As(err, &header_err), IsTrue)
+    c.Expect(header_err.Err, Equals, vorbis.ErrCodebookSync)
+  })
+
+  c.Specify("Randomly damaged setup headers give errors rather than panics", func() {
+    rng := rand.New(rand.NewSource(23))
+    for i := 0; i < 200; i++ {
+      data := rewrite(func(setup []byte) {
+        for j := 0; j < 4; j++ {
+          setup[7+rng.Intn(len(setup)-7)] ^= byte(1 << uint(rng.Intn(8)))
+        }
+      })
+      d, err := vorbis.NewDecoder(bytes.NewReader(data))
+      if err != nil {
+        var header_err *vorbis.HeaderError
+        c.Expect(errors.As(err, &header_err), IsTrue)
+        continue
+      }
+      decodeAll(d)
+    }
+  })
+}
+
+func LimitsSpec(c gospec.Context) {
+  original, err := ioutil.ReadFile("metroid.ogg")
+  c.Assume(err, Equals, nil)
+  packets, err := readAllPackets(ogg.NewPacketReader(bytes.NewReader(original)))
+  c.Assume(err, Equals, io.EOF)
+
+  c.Specify("Packets over Max_packet_size are dropped and reading carries on", func() {
+    limits := ogg.Limits{Max_packet_size: 1000}
+    pr := ogg.NewPacketReaderWithOptions(bytes.NewReader(original), ogg.Options{Limits: limits})
+    var read [][]byte
+    dropped := 0
+    for {
+      packet, err := pr.ReadPacket()
+      if err == io.EOF {
+        break
+      }
+      if err != nil {
+        c.Expect(errors.Is(err, ogg.ErrLimitExceeded), IsTrue)
+        var limit_err *ogg.LimitError
+        c.Assume(errors.As(err, &limit_err), IsTrue)
+        c.Expect(limit_err.Limit, Equals, "Max_packet_size")
+        c.Expect(limit_err.Value > 1000, IsTrue)
+        dropped++
+        continue
+      }
+      read = append(read, packet.Data)
+    }
+    var small [][]byte
+    for _, packet := range packets {
+      if len(packet) <= 1000 {
+        small = append(small, packet)
+      }
+    }
+    c.Expect(dropped, Equals, len(packets)-len(small))
+    c.Expect(dropped > 0, IsTrue)
+    c.Expect(read, Equals, small)
+  })
+
+  c.Specify("Pages over Max_page_size are reported with their offsets", func() {
+    pages := splitPages(original)
+    pr := ogg.NewPageReader(bytes.NewReader(original), ogg.Options{Limits: ogg.Limits{Max_page_size: 4000}})
+    var offset int64
+    for _, page := range pages {
+      _, err := pr.ReadPage()
+      if len(page) <= 4000 {
+        c.Expect(err, Equals, nil)
+      } else {
+        var page_err *ogg.PageError
+        c.Assume(errors.As(err, &page_err), IsTrue)
+        c.Expect(errors.Is(err, ogg.ErrLimitExceeded), IsTrue)
+        c.Expect(page_err.Offset, Equals, offset)
+      }
+      offset += int64(len(page))
+    }
+    _, err := pr.ReadPage()
+    c.Expect(err, Equals, io.EOF)
+  })
+
+  c.Specify("Decode gives its limits to the codecs", func() {
+    c.Expect(ogg.DecodeWithOptions(bytes.NewReader(original), ogg.Options{Limits: ogg.Limits{Max_channels: 2}}), Equals, nil)
+    err := ogg.DecodeWithOptions(bytes.NewReader(original), ogg.Options{Limits: ogg.Limits{Max_channels: 1}})
+    c.Expect(errors.Is(err, ogg.ErrLimitExceeded), IsTrue)
+    var header_err *vorbis.HeaderError
+    c.Expect(errors.As(err, &header_err), IsTrue)
+  })
 }
@@ -0,0 +1,266 @@
+package foo_test
+
+import (
+  . "gospec"
+  "gospec"
+  "ogg"
+  "ogg/vorbis"
+  "bytes"
+  "errors"
+  "flag"
+  "io"
+  "io/ioutil"
+  "path/filepath"
+  "testing"
+)
+
+// Each stream in testdata/malformed is the start of metroid.ogg with its
+// pages damaged in a way that the page and packet readers have to notice or
+// work around, the Vorbis headers themselves are left alone.  Keeping the
+// damaged files rather than only the code that damages them means a change to
+// the writer can't quietly change what's being tested, and the fuzz targets
+// start from them.  -update_corpus rewrites them from malformed_streams.
+var update_corpus = flag.Bool("update_corpus", false, "Rebuild the streams in testdata/malformed")
+
+// A malformedStream says how to damage the pages of the short stream and what
+// ogg.Decode should give for the result.  err is matched with errors.Is, and
+// nil means that the damage is survivable.
+type malformedStream struct {
+  name  string
+  build func(pages [][]byte) [][]byte
+  err   error
+}
+
+var malformed_streams = []malformedStream{
+  {"truncated-page.ogg", func(pages [][]byte) [][]byte {
+    last := len(pages) - 1
+    pages[last] = pages[last][0 : len(pages[last])/2]
+    return pages
+  }, ogg.ErrTruncatedPage},
+
+  {"junk-before-first-page.ogg", func(pages [][]byte) [][]byte {
+    return append([][]byte{[]byte("ID3 and some other junk, OggS but not a page")}, pages...)
+  }, nil},
+
+  {"bad-version.ogg", func(pages [][]byte) [][]byte {
+    pages[1][4] = 1
+    return pages
+  }, ogg.ErrVersion},
+
+  {"bad-crc.ogg", func(pages [][]byte) [][]byte {
+    pages[2][len(pages[2])-1] ^= 0x10
+    return pages
+  }, ogg.ErrCRC},
+
+  {"duplicate-bos.ogg", func(pages [][]byte) [][]byte {
+    return append(pages[0:2], append([][]byte{pages[0]}, pages[2:]...)...)
+  }, ogg.ErrDuplicateBOS},
+
+  {"missing-bos.ogg", func(pages [][]byte) [][]byte {
+    return pages[1:]
+  }, ogg.ErrMissingBOS},
+
+  {"unfinished.ogg", func(pages [][]byte) [][]byte {
+    return pages[0 : len(pages)-1]
+  }, ogg.ErrUnfinishedStreams},
+
+  // The id header's lacing says it carries on to the next page, which isn't
+  // continued, so the id header is lost and the comment header comes first.
+  {"bogus-lacing.ogg", func(pages [][]byte) [][]byte {
+    page := pages[0]
+    data := page[28:]
+    lacing := append([]byte(nil), page[0:28]...)
+    lacing[27] = 255
+    pages[0] = fixCRC(append(lacing, append(data, make([]byte, 255-len(data))...)...))
+    return pages
+  }, vorbis.ErrNotVorbis},
+
+  // The last packet ends with a lacing value of 255, so it never finishes
+  // and is dropped.
+  {"unterminated-packet.ogg", func(pages [][]byte) [][]byte {
+    last := pages[len(pages)-1]
+    end := 27 + int(last[26]) - 1
+    padding := 255 - int(last[end])
+    last[end] = 255
+    pages[len(pages)-1] = fixCRC(append(last, make([]byte, padding)...))
+    return pages
+  }, nil},
+}
+
+// fixCRC puts the right CRC into a page that has been edited
+func fixCRC(page []byte) []byte {
+  copy(page[22:26], []byte{0, 0, 0, 0})
+  crc := referenceCRC(page)
+  page[22], page[23], page[24], page[25] = byte(crc), byte(crc>>8), byte(crc>>16), byte(crc>>24)
+  return page
+}
+
+// shortStream returns the headers and first few audio packets of
+// metroid.ogg as a complete stream, with the headers on pages of their own.
+func shortStream() ([]byte, error) {
+  original, err := ioutil.ReadFile("metroid.ogg")
+  if err != nil {
+    return nil, err
+  }
+  packets, err := readAllPackets(ogg.NewPacketReader(bytes.NewReader(original)))
+  if err != io.EOF {
+    return nil, err
+  }
+  out := bytes.NewBuffer(nil)
+  w := ogg.NewWriter(out, 1)
+  w.Page_size = 1024
+  for i, packet := range packets[0:13] {
+    w.WritePacket(packet, uint64(i))
+    if i < 3 {
+      w.Flush()
+    }
+  }
+  w.Close()
+  return out.Bytes(), nil
+}
+
+// readMalformed returns the streams in testdata/malformed in the same order
+// as malformed_streams, rebuilding them first if -update_corpus was given.
+func readMalformed() ([][]byte, error) {
+  short, err := shortStream()
+  if err != nil {
+    return nil, err
+  }
+  var streams [][]byte
+  for _, stream := range malformed_streams {
+    path := filepath.Join("testdata", "malformed", stream.name)
+    if *update_corpus {
+      pages := splitPages(short)
+      for i := range pages {
+        pages[i] = append([]byte(nil), pages[i]...)
+      }
+      if err := ioutil.WriteFile(path, bytes.Join(stream.build(pages), nil), 0644); err != nil {
+        return nil, err
+      }
+    }
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+      return nil, err
+    }
+    streams = append(streams, data)
+  }
+  return streams, nil
+}
+
+func MalformedSpec(c gospec.Context) {
+  streams, err := readMalformed()
+  c.Assume(err, Equals, nil)
+
+  c.Specify("The malformed streams give the expected errors", func() {
+    for i, stream := range malformed_streams {
+      err := ogg.Decode(bytes.NewReader(streams[i]))
+      if stream.err == nil {
+        c.Expect(err, Equals, nil)
+      } else {
+        c.Expect(errors.Is(err, stream.err), IsTrue)
+      }
+    }
+  })
+
+  c.Specify("The malformed streams can be read by a Decoder without panicking", func() {
+    for i := range malformed_streams {
+      d, err := vorbis.NewDecoder(bytes.NewReader(streams[i]))
+      if err == nil {
+        decodeAll(d)
+      }
+    }
+  })
+}
+
+// addSeeds adds the malformed streams to the corpus of a fuzz target
+func addSeeds(f *testing.F) {
+  streams, err := readMalformed()
+  if err != nil {
+    f.Fatal(err)
+  }
+  for _, stream := range streams {
+    f.Add(stream)
+  }
+}
+
+func FuzzDecodePage(f *testing.F) {
+  short, err := shortStream()
+  if err != nil {
+    f.Fatal(err)
+  }
+  for _, page := range splitPages(short)[0:4] {
+    f.Add(page)
+  }
+  addSeeds(f)
+  f.Fuzz(func(t *testing.T, data []byte) {
+    page, err := ogg.DecodePage(bytes.NewReader(data))
+    if err == io.EOF {
+      return
+    }
+    var page_err *ogg.PageError
+    var crc_err *ogg.CRCError
+    if err != nil && !errors.As(err, &page_err) && !errors.As(err, &crc_err) {
+      t.Fatalf("Unexpected error type: %v", err)
+    }
+    if err != nil && crc_err == nil {
+      return
+    }
+    if len(page.Segment_table) != int(page.Page_segments) {
+      t.Fatalf("%d segments, expected %d", len(page.Segment_table), page.Page_segments)
+    }
+    size := 0
+    for _, seg_len := range page.Segment_table {
+      size += int(seg_len)
+    }
+    if size != len(page.Data) {
+      t.Fatalf("%d bytes of data, the segment table says %d", len(page.Data), size)
+    }
+  })
+}
+
+// checkDecodeError fails unless err is one of the errors that damaged input
+// is reported with.
+func checkDecodeError(t *testing.T, err error) {
+  if err == nil || err == io.EOF {
+    return
+  }
+  var page_err *ogg.PageError
+  var crc_err *ogg.CRCError
+  var unfinished_err *ogg.UnfinishedError
+  var limit_err *ogg.LimitError
+  var header_err *vorbis.HeaderError
+  switch {
+  case errors.As(err, &page_err):
+  case errors.As(err, &crc_err):
+  case errors.As(err, &unfinished_err):
+  case errors.As(err, &limit_err):
+  case errors.As(err, &header_err):
+  default:
+    t.Fatalf("Unexpected error type: %v", err)
+  }
+}
+
+// FuzzDecode runs the whole of Decode, which puts packets back together and
+// passes them to the Vorbis codec, and also reads the packets with a
+// PacketReader.
+func FuzzDecode(f *testing.F) {
+  addSeeds(f)
+  f.Fuzz(func(t *testing.T, data []byte) {
+    checkDecodeError(t, ogg.DecodeWithOptions(bytes.NewReader(data), ogg.Options{Skip_corrupt_pages: true}))
+    checkDecodeError(t, ogg.Decode(bytes.NewReader(data)))
+
+    pr := ogg.NewPacketReader(bytes.NewReader(data))
+    total := 0
+    for {
+      packet, err := pr.ReadPacket()
+      if err != nil {
+        checkDecodeError(t, err)
+        break
+      }
+      total += len(packet.Data)
+      if total > len(data) {
+        t.Fatalf("Read %d bytes of packets from %d bytes of input", total, len(data))
+      }
+    }
+  })
+}
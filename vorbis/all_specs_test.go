@@ -7,9 +7,21 @@ import (
 
 func TestAllSpecs(t *testing.T) {
   r := gospec.NewRunner()
-  //  r.AddSpec(BitReaderSpec)
+  r.AddSpec(BitReaderSpec)
   r.AddSpec(Lookup1Spec)
   r.AddSpec(HuffmanAssignmentSpec)
   r.AddSpec(HuffmanDecodeSpec)
+  r.AddSpec(IMDCTSpec)
+  r.AddSpec(WindowSpec)
+  r.AddSpec(SynthesisSpec)
+  r.AddSpec(Floor0Spec)
+  r.AddSpec(CodebookLookupSpec)
+  r.AddSpec(SpectrumSpec)
+  r.AddSpec(TruncatedPacketSpec)
+  r.AddSpec(ResidueSpec)
+  r.AddSpec(ConcurrentDecodeSpec)
+  r.AddSpec(HeaderErrorSpec)
+  r.AddSpec(LimitsSpec)
+  r.AddSpec(BadHeaderSpec)
   gospec.MainGoTest(r, t)
 }
@@ -1,18 +1,30 @@
 package vorbis
 
-import "io"
+import (
+  "encoding/binary"
+  "io"
+)
 
+// A BitReader reads the bits of a single packet, least significant bit
+// first.  Reading past the end of the packet returns zeros and sets a sticky
+// error that CheckError reports from then on.
 type BitReader struct {
-  in      io.ByteReader
-  current byte
-  bit_pos int
-  err     error
+  data []byte
+
+  // The next byte of data that hasn't been loaded into acc
+  pos int
+
+  // Bits that have been loaded but not read yet, the next bit in the packet
+  // is the lowest bit of acc.  Every bit above count is zero.
+  acc   uint64
+  count int
+
+  err error
 }
 
-func MakeBitReader(in io.ByteReader) *BitReader {
+func MakeBitReader(data []byte) *BitReader {
   var br BitReader
-  br.in = in
-  br.bit_pos = 8
+  br.data = data
   return &br
 }
 
@@ -20,42 +32,79 @@ func (br *BitReader) CheckError() error {
   return br.err
 }
 
-// 0 <= n < 8
-func (br *BitReader) readAtMost(n int) (read int, bits uint32) {
-  bits = uint32(br.current)
-  bits = bits >> uint(br.bit_pos)
-  bits = bits & ((1 << uint(n)) - 1)
-  read = 8 - br.bit_pos
-  if read > n {
-    read = n
+// BitsLeft returns the number of bits in the packet that haven't been read
+func (br *BitReader) BitsLeft() int {
+  return br.count + 8*(len(br.data)-br.pos)
+}
+
+// fill loads bytes into acc until it holds at least 56 bits or there are no
+// bytes left, so every read of up to 32 bits only needs a single fill.  The
+// fast path loads whole bytes from a single 64-bit load, which leaves 56 bits
+// when acc starts out empty.
+func (br *BitReader) fill() {
+  if br.count > 56 {
+    return
   }
-  br.bit_pos += read
-  if br.bit_pos == 8 {
-    br.bit_pos = 0
-    var err error
-    br.current, err = br.in.ReadByte()
-    if err != nil {
-      br.err = err
-    }
+  if br.pos+8 <= len(br.data) {
+    bytes := (63 - br.count) / 8
+    next := binary.LittleEndian.Uint64(br.data[br.pos:])
+    br.acc |= next << uint(br.count)
+    br.count += 8 * bytes
+    br.acc &= 1<<uint(br.count) - 1
+    br.pos += bytes
+    return
+  }
+  for br.count <= 56 && br.pos < len(br.data) {
+    br.acc |= uint64(br.data[br.pos]) << uint(br.count)
+    br.count += 8
+    br.pos++
   }
-  return
 }
 
-var total int
-
-// 0 <= n < 32
+// 0 <= n <= 32
+// If the end of the packet is reached part way through a read ReadBits
+// returns 0 and CheckError will return io.EOF from then on.
 func (br *BitReader) ReadBits(n int) uint32 {
-  total += n
-  if br.err != nil {
-    return 0
-  }
-  var bits uint32
-  pos := 0
-  for n > 0 {
-    read, next := br.readAtMost(n)
-    bits = bits | (next << uint(pos))
-    pos += read
-    n -= read
+  if br.count < n {
+    br.fill()
+    if br.count < n {
+      br.SkipBits(n)
+      return 0
+    }
   }
+  bits := uint32(br.acc & (1<<uint(n) - 1))
+  br.acc >>= uint(n)
+  br.count -= n
   return bits
 }
+
+// PeekBits returns the next n bits without consuming them, 0 <= n <= 32.
+// Near the end of the packet fewer than n bits may be left, available is the
+// number of bits that are real, the rest are zero.
+func (br *BitReader) PeekBits(n int) (bits uint32, available int) {
+  if br.count < n {
+    br.fill()
+  }
+  available = br.count
+  if available > n {
+    available = n
+  }
+  return uint32(br.acc & (1<<uint(n) - 1)), available
+}
+
+// SkipBits consumes n bits, which should normally have been looked at with
+// PeekBits first.  Skipping past the end of the packet is an error just like
+// reading past it.
+func (br *BitReader) SkipBits(n int) {
+  if br.count < n {
+    br.fill()
+    if br.count < n {
+      br.err = io.EOF
+      br.acc = 0
+      br.count = 0
+      return
+    }
+  }
+  br.acc >>= uint(n)
+  br.count -= n
+}
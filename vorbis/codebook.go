@@ -1,12 +1,15 @@
 package vorbis
 
-import "math"
+import (
+  "math"
+  "ogg"
+  "unsafe"
+)
 
 type CodebookEntry struct {
   Unused   bool
   Length   int
   Codeword uint32
-  Num      int
 }
 
 type Codebook struct {
@@ -20,6 +23,9 @@ type Codebook struct {
 
   // Value_vectors[entry][dimension]
   Value_vectors [][]float64
+
+  // Built by AssignCodewords
+  table huffmanTable
 }
 
 func toBin(n uint32, l int) string {
@@ -38,46 +44,41 @@ func toBin(n uint32, l int) string {
   return ret
 }
 
+// DecodeScalar reads a single codeword and returns its entry number.  If the
+// end of the packet is reached first it returns -1.
 func (book *Codebook) DecodeScalar(br *BitReader) int {
-  // TODO: This obviously needs to be seriously optimized
-  var word uint32
-  for length := 0; length < 32; length++ {
-    for i := range book.Entries {
-      if book.Entries[i].Unused {
-        continue
-      }
-      if book.Entries[i].Length == length && book.Entries[i].Codeword == word {
-        return book.Entries[i].Num
-      }
-    }
-    word = word << 1
-    bit := br.ReadBits(1)
-    word |= bit
+  if br.CheckError() != nil {
+    return -1
   }
-  panic("Codebook failed to decode properly.")
+  return book.table.decode(br)
 }
 
+// DecodeVector reads a single codeword and returns its value vector.  If the
+// end of the packet is reached first it returns nil.
 func (book *Codebook) DecodeVector(br *BitReader) []float64 {
   index := book.DecodeScalar(br)
+  if index < 0 {
+    return nil
+  }
   return book.Value_vectors[index]
 }
 
 func (book *Codebook) allocateTable() {
   // Build the table out of a single array
   vector := make([]float64, len(book.Entries)*book.Dimensions)
-  book.Value_vectors = make([][]float64, book.Dimensions)
+  book.Value_vectors = make([][]float64, len(book.Entries))
   for i := range book.Value_vectors {
-    book.Value_vectors[i] = vector[i*len(book.Entries) : (i+1)*len(book.Entries)]
+    book.Value_vectors[i] = vector[i*book.Dimensions : (i+1)*book.Dimensions]
   }
 }
 
 func (book *Codebook) BuildVQType1() {
   book.allocateTable()
-  for dim := range book.Value_vectors[0] {
+  for entry := range book.Value_vectors {
     last := 0.0
     index_divisor := 1
-    for entry := range book.Value_vectors {
-      offset := (dim / index_divisor) % len(book.Multiplicands)
+    for dim := range book.Value_vectors[entry] {
+      offset := (entry / index_divisor) % len(book.Multiplicands)
       // TODO: The java implementation takes the absolute value of the Multiplicand here, find out if that is necessary or meaningful
       book.Value_vectors[entry][dim] = float64(book.Multiplicands[offset])*book.Delta_value + book.Minimum_value + last
       if book.Sequence_p {
@@ -89,8 +90,8 @@ func (book *Codebook) BuildVQType1() {
 }
 func (book *Codebook) BuildVQType2() {
   book.allocateTable()
-  last := 0.0
   for entry := range book.Value_vectors {
+    last := 0.0
     offset := entry * book.Dimensions
     for dim := range book.Value_vectors[entry] {
       // TODO: Same thing with absolute value in the java implementation
@@ -103,7 +104,9 @@ func (book *Codebook) BuildVQType2() {
   }
 }
 
-func (book *Codebook) AssignCodewords() {
+// AssignCodewords gives each used entry its codeword, it returns an error if
+// the lengths describe an overspecified tree.
+func (book *Codebook) AssignCodewords() error {
   marker := make([]uint32, 33)
   for i := range book.Entries {
     entry := &book.Entries[i]
@@ -115,7 +118,7 @@ func (book *Codebook) AssignCodewords() {
     }
     word := marker[entry.Length]
     if entry.Length < 32 && (word>>uint(entry.Length)) != 0 {
-      panic("Codebook contains an overspecified huffman tree.")
+      return setupError("codeword lengths", ErrCodebook)
     }
 
     entry.Codeword = word
@@ -140,44 +143,71 @@ func (book *Codebook) AssignCodewords() {
       }
     }
   }
+
+  book.buildHuffmanTable()
+  return nil
+}
+
+// float32Unpack converts the packed floating point format used in codebook
+// headers, which is not the same as IEEE 754.
+func float32Unpack(x uint32) float64 {
+  mantissa := float64(x & 0x1fffff)
+  if x&0x80000000 != 0 {
+    mantissa = -mantissa
+  }
+  exponent := int((x & 0x7fe00000) >> 21)
+  return math.Ldexp(mantissa, exponent-788)
 }
 
-func (book *Codebook) decode(br *BitReader) {
+// decode reads a codebook from the setup header and builds its tables, the
+// memory they need is taken from budget first.
+func (book *Codebook) decode(br *BitReader, budget *setupBudget) error {
   if br.ReadBits(24) != 0x564342 {
-    panic("Codebook sync pattern not found")
+    return setupError("sync pattern", ErrCodebookSync)
   }
 
   book.Dimensions = int(br.ReadBits(16))
   num_entries := int(br.ReadBits(24))
-  book.Entries = make([]CodebookEntry, num_entries)
   ordered := br.ReadBits(1) == 1
+  // Unless the lengths are ordered every entry takes at least a bit, so the
+  // number of entries can be checked before anything is allocated for them.
+  if !ordered && num_entries > br.BitsLeft() {
+    return setupError("entries", ErrTruncatedHeader)
+  }
+  if num_entries > budget.limits.Max_codebook_entries {
+    return setupError("entries", &ogg.LimitError{Limit: "Max_codebook_entries", Value: int64(num_entries), Max: int64(budget.limits.Max_codebook_entries)})
+  }
+  // Each entry also gets a huffmanCode if its codeword is long
+  entry_size := int64(unsafe.Sizeof(CodebookEntry{}) + unsafe.Sizeof(huffmanCode{}))
+  if err := budget.take("entries", int64(num_entries)*entry_size); err != nil {
+    return err
+  }
+  book.Entries = make([]CodebookEntry, num_entries)
 
   // Decode codeword lengths
   if ordered {
+    // Entries are listed in order of length, each run of entries is one bit
+    // longer than the last.
     current_entry := 0
+    current_length := int(br.ReadBits(5)) + 1
     for current_entry < num_entries {
-      current_length := int(br.ReadBits(5)) + 1
       number := int(br.ReadBits(ilog(uint32(num_entries - current_entry))))
+      if current_entry+number > num_entries || current_length > 32 {
+        return setupError("ordered codeword lengths", ErrCodebook)
+      }
       for i := 0; i < number; i++ {
         book.Entries[current_entry+i].Length = current_length
-        book.Entries[current_entry+i].Num = current_entry + i
       }
       current_length++
       current_entry += number
-      if current_entry >= num_entries {
-        panic("Error decoding Codebooks")
-      }
     }
   } else {
     sparse := br.ReadBits(1) == 1
     if sparse {
-      current_entry := 0
       for i := range book.Entries {
         flag := br.ReadBits(1) == 1
         if flag {
           book.Entries[i].Length = int(br.ReadBits(5)) + 1
-          book.Entries[i].Num = current_entry
-          current_entry++
         } else {
           book.Entries[i].Unused = true
         }
@@ -198,27 +228,44 @@ func (book *Codebook) decode(br *BitReader) {
   case 1:
     fallthrough
   case 2:
-    book.Minimum_value = float64(math.Float32frombits(br.ReadBits(32)))
-    book.Delta_value = float64(math.Float32frombits(br.ReadBits(32)))
+    book.Minimum_value = float32Unpack(br.ReadBits(32))
+    book.Delta_value = float32Unpack(br.ReadBits(32))
     Codebook_value_bits := int(br.ReadBits(4) + 1)
     book.Sequence_p = br.ReadBits(1) == 1
+    if book.Dimensions == 0 {
+      return setupError("dimensions", ErrCodebook)
+    }
     var Codebook_lookup_values int
     if Codebook_lookup_type == 1 {
       Codebook_lookup_values = Lookup1Values(len(book.Entries), book.Dimensions)
     } else {
       Codebook_lookup_values = len(book.Entries) * book.Dimensions
     }
+    if Codebook_lookup_values*Codebook_value_bits > br.BitsLeft() {
+      return setupError("multiplicands", ErrTruncatedHeader)
+    }
+    // The value vectors are built from the multiplicands, one float for
+    // each dimension of each entry.
+    vector_size := int64(book.Dimensions)*8 + int64(unsafe.Sizeof([]float64{}))
+    if err := budget.take("value vectors", int64(Codebook_lookup_values)*4+int64(num_entries)*vector_size); err != nil {
+      return err
+    }
     book.Multiplicands = make([]uint32, Codebook_lookup_values)
     for i := range book.Multiplicands {
       book.Multiplicands[i] = br.ReadBits(Codebook_value_bits)
     }
 
   default:
-    panic("Unknown vector lookup method")
+    return setupError("lookup type", ErrReserved)
+  }
+  if br.CheckError() != nil {
+    return setupError("codebook", ErrTruncatedHeader)
   }
 
   // Assign huffman values
-  book.AssignCodewords()
+  if err := book.AssignCodewords(); err != nil {
+    return err
+  }
 
   switch Codebook_lookup_type {
   case 1:
@@ -226,4 +273,5 @@ func (book *Codebook) decode(br *BitReader) {
   case 2:
     book.BuildVQType2()
   }
+  return nil
 }
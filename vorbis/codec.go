@@ -1,35 +1,48 @@
 package vorbis
 
 import (
-  "fmt"
   "ogg"
   "bytes"
-  "io"
   "math"
-  "cmath"
-  "fftw"
+  "encoding/binary"
 )
 
-var magic_string string = "\x01vorbis"
+const magic_string = "\x01vorbis"
 
-func check(err error) {
-  if err != nil {
-    panic(err.Error())
+// readAudioPacket decodes a single audio packet and returns the finished
+// samples for each channel.  The first audio packet only primes the overlap
+// and so returns no samples, after that each packet returns the samples from
+// the center of the previous block to the center of this one.
+func (v *vorbisDecoder) readAudioPacket(data []byte, num_channels int) [][]float64 {
+  br := MakeBitReader(data)
+  spectra, window := v.decodeSpectra(br, num_channels)
+  if window == nil {
+    return nil
   }
+  return v.synthesize(spectra, window)
 }
 
-func (v *vorbisDecoder) readAudioPacket(buffer io.ByteReader, num_channels int) {
-  br := MakeBitReader(buffer)
-
+// decodeSpectra decodes the spectrum of every channel in an audio packet, it
+// also returns the window that should be applied once the spectra have been
+// transformed.  If the packet can't be decoded the window will be nil.  An
+// unused channel has a nil spectrum.
+func (v *vorbisDecoder) decodeSpectra(br *BitReader, num_channels int) ([][]float64, []float64) {
   if br.ReadBits(1) != 0 {
-    fmt.Printf("Warning: Not an audio packet")
-    return
+    // Not an audio packet, these are ignored
+    return nil, nil
   }
   mode_number := int(br.ReadBits(ilog(uint32(len(v.Mode_configs)) - 1)))
+  if mode_number >= len(v.Mode_configs) {
+    return nil, nil
+  }
   mode := v.Mode_configs[mode_number]
   mapping := v.Mapping_configs[mode.mapping]
 
-  window := v.generateWindow(br, mode)
+  window := v.readWindow(br, mode)
+  if window == nil {
+    return nil, nil
+  }
+  n := len(window) / 2
 
   // Floor curves
   // If the output for a floor for a particular channel is 'unused' that
@@ -39,42 +52,42 @@ func (v *vorbisDecoder) readAudioPacket(buffer io.ByteReader, num_channels int)
     submap_number := mapping.muxs[i]
     floor_number := mapping.submaps[submap_number].floor
     floor := v.Floor_configs[floor_number]
-
-    // TODO: Not entirely sure we should be dividing by two here...
-    floor_outputs[i] = floor.Decode(br, v.Codebooks, len(window)/2)
+    floor_outputs[i] = floor.Decode(br, v.Codebooks, n)
   }
 
   if br.CheckError() != nil {
-    // TODO: Need to handle an EOF error by zeroing channel data and skipping
-    // to the add/overlap output stage
-    panic("Not implemented")
+    // The spec allows the packet to end during floor decode, in which case
+    // all of the channels are zeroed and we skip straight to overlap-add.
+    return make([][]float64, num_channels), window
   }
 
   // non-zero vector propagate
-  // If any coupling has either angle or magnitude unused, then we can't use
-  // either.  The spec doesn't seem to specify if channels can be used by more
-  // than one coupling, but I suspect not, so this should be an ok way to
-  // handle this.
+  // A channel with an unused floor still needs its residue decoded if it is
+  // coupled with a channel that is used, since the coupling will mix them.
+  no_residue := make([]bool, num_channels)
+  for i := range floor_outputs {
+    no_residue[i] = floor_outputs[i] == nil
+  }
   for _, coupling := range mapping.couplings {
-    if floor_outputs[coupling.angle] == nil || floor_outputs[coupling.magnitude] == nil {
-      floor_outputs[coupling.angle] = nil
-      floor_outputs[coupling.magnitude] = nil
+    if !no_residue[coupling.magnitude] || !no_residue[coupling.angle] {
+      no_residue[coupling.magnitude] = false
+      no_residue[coupling.angle] = false
     }
   }
 
   // residue decode
-  do_not_decode := make([]bool, num_channels)
+  // Each submap decodes the residues for the channels that are muxed to it,
+  // in channel order.
   residue_outputs := make([][]float64, num_channels)
   for i, submap := range mapping.submaps {
-    ch := 0
+    var do_not_decode []bool
     for j := 0; j < num_channels; j++ {
       if mapping.muxs[j] == i {
-        do_not_decode[ch] = floor_outputs[j] == nil
-        ch++
+        do_not_decode = append(do_not_decode, no_residue[j])
       }
     }
-    residues := v.Residue_configs[submap.residue].Decode(br, v.Codebooks, ch, do_not_decode, len(window)/2)
-    ch = 0
+    residues := v.Residue_configs[submap.residue].Decode(br, v.Codebooks, len(do_not_decode), do_not_decode, n)
+    ch := 0
     for j := 0; j < num_channels; j++ {
       if mapping.muxs[j] == i {
         residue_outputs[j] = residues[ch]
@@ -114,96 +127,167 @@ func (v *vorbisDecoder) readAudioPacket(buffer io.ByteReader, num_channels int)
   }
 
   // dot product
-//  fmt.Printf("%d %d\n", len(floor_outputs), len(residue_outputs))
-//  for i := range floor_outputs {
-//    fmt.Printf("%d %d\n", len(floor_outputs[i]), len(residue_outputs[i]))
-//    for j := range floor_outputs[i] {
-//      floor_outputs[i][j] *= residue_outputs[i][j]
-//    }
-//  }
-
-  // iMDCT
-  // TODO: This needs to be written in native go - half the point of this is
-  // to support vorbis without requiring cgo.
-  var final [][]float64
-  for i := range mapping.couplings {
-    mag := mapping.couplings[i].magnitude
-    ang := mapping.couplings[i].angle
-    if floor_outputs[mag] == nil {
+  // Channels with an unused floor are left nil, their output is all zeros
+  // regardless of their residue.
+  for i := range floor_outputs {
+    if floor_outputs[i] == nil {
       continue
     }
-    in := make([]complex128, len(floor_outputs[mag]))
-    next := make([]float64, 2*(len(floor_outputs[ang])-1))
-    for i := range in {
-      in[i] = cmath.Rect(floor_outputs[mag][i], floor_outputs[ang][i])
+    for j := range floor_outputs[i] {
+      floor_outputs[i][j] *= residue_outputs[i][j]
     }
-    fftw.PlanDftC2R1d(in, next, fftw.Estimate).Execute()
-    final = append(final, next)
   }
+
+  return floor_outputs, window
 }
 
-func (v *vorbisDecoder) generateWindow(br *BitReader, mode Mode) []float64 {
-  var n int
-  if mode.block_flag {
-    n = v.Blocksize_1
-  } else {
-    n = v.Blocksize_0
+// synthesize runs the inverse MDCT over the spectrum of each channel, applies
+// the window and overlap-adds the result with the previous block.  A nil
+// spectrum is treated as all zeros.
+func (v *vorbisDecoder) synthesize(spectra [][]float64, window []float64) [][]float64 {
+  transform := v.imdcts[0]
+  if len(window) == v.Blocksize_1 {
+    transform = v.imdcts[1]
   }
+  final := make([][]float64, len(spectra))
+  for i := range spectra {
+    final[i] = make([]float64, transform.n)
+    if spectra[i] == nil {
+      continue
+    }
+    transform.inverse(spectra[i], final[i])
+    for j := range final[i] {
+      final[i][j] *= window[j]
+    }
+  }
+  return v.overlapAdd(final)
+}
 
+// overlapAdd adds the left half of block to the right half of the previously
+// decoded block and returns the finished samples, which run from the center
+// of the previous block to the center of this one.  That is
+// previous_blocksize/4 + current_blocksize/4 samples for each channel.
+func (v *vorbisDecoder) overlapAdd(block [][]float64) [][]float64 {
+  previous := v.previous
+  v.previous = block
+  if previous == nil {
+    return nil
+  }
+
+  pn := len(previous[0])
+  cn := len(block[0])
+
+  // The blocks are lined up so that 3/4 of the way through the previous block
+  // is 1/4 of the way through the current one.  Since the windows are zero
+  // outside of their slopes we only need to worry about running off the ends.
+  offset := cn/4 - pn/4
+  output := make([][]float64, len(block))
+  for i := range output {
+    output[i] = make([]float64, pn/4+cn/4)
+    for j := range output[i] {
+      if c := offset + j; c >= 0 {
+        output[i][j] = block[i][c]
+      }
+      if p := pn/2 + j; p < pn {
+        output[i][j] += previous[i][p]
+      }
+    }
+  }
+  return output
+}
+
+// blocksize returns the size of the block in an audio packet without decoding
+// it, or 0 if the packet isn't an audio packet.
+func (v *vorbisDecoder) blocksize(data []byte) int {
+  br := MakeBitReader(data)
+  if br.ReadBits(1) != 0 {
+    return 0
+  }
+  mode_number := int(br.ReadBits(ilog(uint32(len(v.Mode_configs)) - 1)))
+  if br.CheckError() != nil || mode_number >= len(v.Mode_configs) {
+    return 0
+  }
+  if v.Mode_configs[mode_number].block_flag {
+    return v.Blocksize_1
+  }
+  return v.Blocksize_0
+}
+
+// readWindow reads the window flags for a block, if it has any, and returns
+// the appropriate precomputed window.
+func (v *vorbisDecoder) readWindow(br *BitReader, mode Mode) []float64 {
   // window selection and setup
-  var prev_window_flag, next_window_flag bool
+  var prev_window_flag, next_window_flag int
   if mode.block_flag {
-    prev_window_flag = br.ReadBits(1) == 1
-    next_window_flag = br.ReadBits(1) == 1
+    prev_window_flag = int(br.ReadBits(1))
+    next_window_flag = int(br.ReadBits(1))
   }
 
-  // An end of stream error is possible here, just bail on this packet
-  // TODO: Need to make it possible to reset the bitreader, or just need to make
-  // a new one whenever it encounters an error
-  // TODO: Mayeb just panic?  Perhaps after successfully reading the headers all
-  // panics can just indicate the current packet is bad and further decoding
-  // can go ahead as normal
+  // If the packet ends before the window flags have been read the packet is
+  // discarded entirely, it doesn't even take part in overlap-add.
   if br.CheckError() != nil {
     return nil
   }
 
-  // generate window
+  if mode.block_flag {
+    return v.windows[1][prev_window_flag][next_window_flag]
+  }
+  return v.windows[0][0][0]
+}
+
+// generateWindows precomputes the window for every combination of block size
+// and neighbouring block sizes.  Short blocks always have the same window
+// since their slopes can't be any longer than Blocksize_0/2.
+func (v *vorbisDecoder) generateWindows() {
+  short := generateWindow(v.Blocksize_0, v.Blocksize_0, false, false, false)
+  for prev := 0; prev < 2; prev++ {
+    for next := 0; next < 2; next++ {
+      v.windows[0][prev][next] = short
+      v.windows[1][prev][next] = generateWindow(v.Blocksize_1, v.Blocksize_0, true, prev == 1, next == 1)
+    }
+  }
+}
+
+// generateWindow returns the window for a block of size n.  For long blocks
+// prev and next indicate whether the previous and next blocks are also long,
+// if they are not the slope on that side is shortened to match.
+func generateWindow(n, blocksize_0 int, long, prev, next bool) []float64 {
   window_center := n / 2
   var left_window_start, left_window_end, left_n int
   var right_window_start, right_window_end, right_n int
-  if mode.block_flag {
-    if prev_window_flag {
-      left_window_start = 0
-      left_window_end = window_center
-      left_n = n / 2
-    } else {
-      left_window_start = n/4 - v.Blocksize_0/4
-      left_window_end = n/4 + v.Blocksize_0/4
-      left_n = v.Blocksize_0 / 2
-    }
-    if next_window_flag {
-      left_window_start = window_center
-      left_window_end = n
-      left_n = n / 2
-    } else {
-      left_window_start = (n*3)/4 - v.Blocksize_0/4
-      left_window_end = (n*3)/4 + v.Blocksize_0/4
-      left_n = v.Blocksize_0 / 2
-    }
+  if long && !prev {
+    left_window_start = n/4 - blocksize_0/4
+    left_window_end = n/4 + blocksize_0/4
+    left_n = blocksize_0 / 2
+  } else {
+    left_window_start = 0
+    left_window_end = window_center
+    left_n = n / 2
+  }
+  if long && !next {
+    right_window_start = (n*3)/4 - blocksize_0/4
+    right_window_end = (n*3)/4 + blocksize_0/4
+    right_n = blocksize_0 / 2
+  } else {
+    right_window_start = window_center
+    right_window_end = n
+    right_n = n / 2
   }
 
   window := make([]float64, n)
   const pi_over_2 = math.Pi / 2
   for i := left_window_start; i < left_window_end; i++ {
     base := (float64(i-left_window_start) + 0.5) / float64(left_n) * pi_over_2
-    window[i] = math.Sin(pi_over_2 * math.Pow(math.Sin(base), 2))
+    sin := math.Sin(base)
+    window[i] = math.Sin(pi_over_2 * sin * sin)
   }
   for i := left_window_end; i < right_window_start; i++ {
     window[i] = 1
   }
   for i := right_window_start; i < right_window_end; i++ {
     base := (float64(i-right_window_start)+0.5)/float64(right_n)*pi_over_2 + pi_over_2
-    window[i] = math.Sin(pi_over_2 * math.Pow(math.Sin(base), 2))
+    sin := math.Sin(base)
+    window[i] = math.Sin(pi_over_2 * sin * sin)
   }
 
   return window
@@ -214,10 +298,7 @@ func init() {
 }
 
 func makeVorbisDecoder() ogg.Codec {
-  var v vorbisDecoder
-  v.input = make(chan ogg.Packet, 25)
-  go v.routine()
-  return &v
+  return &vorbisDecoder{}
 }
 
 type codecMode int
@@ -235,46 +316,116 @@ type vorbisDecoder struct {
   commentHeader
   setupHeader
 
-  input chan ogg.Packet
+  // Inverse MDCTs for Blocksize_0 and Blocksize_1
+  imdcts [2]*imdct
+
+  // windows[block_flag][prev_window_flag][next_window_flag]
+  windows [2][2][2][]float64
+
+  // The windowed output of the last audio packet, its right half still needs
+  // to be overlapped with the next packet.
+  previous [][]float64
+
+  // Zero fields are replaced by the defaults when the headers are read
+  limits ogg.Limits
 }
 
-func (v *vorbisDecoder) Input() chan<- ogg.Packet {
-  return v.input
+// prepare builds all of the tables that depend on the headers, it is called
+// once the setup header has been read.
+func (v *vorbisDecoder) prepare() {
+  v.imdcts[0] = makeIMDCT(v.Blocksize_0)
+  v.imdcts[1] = makeIMDCT(v.Blocksize_1)
+  v.generateWindows()
+  for _, floor := range v.Floor_configs {
+    if f, ok := floor.(*Floor0); ok {
+      f.generateBarkMaps(v.Blocksize_0/2, v.Blocksize_1/2)
+    }
+  }
 }
-func (v *vorbisDecoder) routine() {
-  for packet := range v.input {
-    buffer := bytes.NewBuffer(packet.Data)
-    switch v.mode {
-    case readId:
-      v.idHeader.read(buffer)
-      v.mode++
-      fallthrough
-
-    case readComment:
-      // TODO: EOF during this packet is acceptable
-      if buffer.Len() == 0 {
-        // This could happen if the id and comment headers aren't in the
-        // same packet.  The spec really doesn't specify how it should be.
-        // TODO: For this pair of headers this might be specified to never
-        //       happen, so remove this if statement if that's the case.
-        continue
-      }
-      v.commentHeader.read(buffer)
-      v.mode++
-      fallthrough
-
-    case readSetup:
-      if buffer.Len() == 0 {
-        // This could happen if the comment and setup headers aren't in the
-        // same packet.  The spec really doesn't specify how it should be.
-        continue
-      }
-      v.setupHeader.read(buffer, int(v.Channels))
-      v.mode++
-      total = 0
 
-    case readData:
-      v.readAudioPacket(buffer, int(v.Channels))
+// Packet decodes the next packet of the stream.  Nobody is listening for
+// the samples so they are thrown away, but anything wrong with the headers is
+// returned as an error.
+func (v *vorbisDecoder) Packet(packet ogg.Packet) error {
+  _, err := v.readPacket(packet.Data)
+  return err
+}
+
+// Close returns an error if the stream ended before its headers did
+func (v *vorbisDecoder) Close() error {
+  switch v.mode {
+  case readId:
+    return idError("packet missing", ErrTruncatedHeader)
+  case readComment:
+    return commentError("packet missing", ErrTruncatedHeader)
+  case readSetup:
+    return setupError("packet missing", ErrTruncatedHeader)
+  }
+  return nil
+}
+
+// SetLimits sets the limits that the headers are checked against
+func (v *vorbisDecoder) SetLimits(limits ogg.Limits) {
+  v.limits = limits
+}
+
+// Describe reads the channel count and sample rate from an id header, every
+// Vorbis stream has three header packets.
+func (v *vorbisDecoder) Describe(first []byte) (ogg.Parameters, int, bool) {
+  if len(first) < len(magic_string) || string(first[0:len(magic_string)]) != magic_string {
+    return ogg.Parameters{}, 0, false
+  }
+  var fixed idHeaderFixed
+  err := binary.Read(bytes.NewBuffer(first[len(magic_string):]), binary.LittleEndian, &fixed)
+  if err != nil || fixed.Channels == 0 || fixed.Sample_rate == 0 {
+    return ogg.Parameters{}, 0, false
+  }
+  return ogg.Parameters{Channels: int(fixed.Channels), Sample_rate: int(fixed.Sample_rate)}, 3, true
+}
+
+// readPacket handles the next packet in the stream.  The first packets are
+// the three headers, after that every packet is audio and readPacket returns
+// its finished samples.  Only the headers can give an error, audio packets
+// that can't be decoded are skipped as the spec says.
+func (v *vorbisDecoder) readPacket(data []byte) ([][]float64, error) {
+  buffer := bytes.NewBuffer(data)
+  switch v.mode {
+  case readId:
+    if err := v.idHeader.read(buffer, v.limits.WithDefaults()); err != nil {
+      return nil, err
+    }
+    v.mode++
+    fallthrough
+
+  case readComment:
+    // TODO: EOF during this packet is acceptable
+    if buffer.Len() == 0 {
+      // This could happen if the id and comment headers aren't in the
+      // same packet.  The spec really doesn't specify how it should be.
+      // TODO: For this pair of headers this might be specified to never
+      //       happen, so remove this if statement if that's the case.
+      return nil, nil
+    }
+    if err := v.commentHeader.read(buffer, v.limits.WithDefaults()); err != nil {
+      return nil, err
     }
+    v.mode++
+    fallthrough
+
+  case readSetup:
+    if buffer.Len() == 0 {
+      // This could happen if the comment and setup headers aren't in the
+      // same packet.  The spec really doesn't specify how it should be.
+      return nil, nil
+    }
+    if err := v.setupHeader.read(buffer, int(v.Channels), v.limits.WithDefaults()); err != nil {
+      return nil, err
+    }
+    v.prepare()
+    v.mode++
+
+  case readData:
+    return v.readAudioPacket(data, int(v.Channels)), nil
   }
+  return nil, nil
 }
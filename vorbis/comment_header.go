@@ -3,7 +3,7 @@ package vorbis
 import (
   "encoding/binary"
   "bytes"
-  "fmt"
+  "ogg"
 )
 
 type commentHeader struct {
@@ -12,30 +12,60 @@ type commentHeader struct {
   Framing       bool
 }
 
-func (header *commentHeader) read(buffer *bytes.Buffer) {
+func (header *commentHeader) read(buffer *bytes.Buffer, limits ogg.Limits) error {
   b, _ := buffer.ReadByte()
   if b != 3 {
-    panic(fmt.Sprintf("Header type == %d, expected type == 3.", b))
+    return commentError("packet type", ErrNotVorbis)
   }
 
   if string(buffer.Next(6)) != "vorbis" {
-    panic("vorbis string not found in comment header")
+    return commentError("vorbis string", ErrNotVorbis)
   }
 
+  // Every length is checked against what's left of the packet and against
+  // Max_comment_bytes before anything is allocated for it.
+  var total int64
+  take := func(field string, n uint32) error {
+    total += int64(n)
+    if total > int64(limits.Max_comment_bytes) {
+      return commentError(field, &ogg.LimitError{Limit: "Max_comment_bytes", Value: total, Max: int64(limits.Max_comment_bytes)})
+    }
+    return nil
+  }
   var length uint32
-  binary.Read(buffer, binary.LittleEndian, &length)
+  if binary.Read(buffer, binary.LittleEndian, &length) != nil || int64(length) > int64(buffer.Len()) {
+    return commentError("vendor string", ErrTruncatedHeader)
+  }
+  if err := take("vendor string", length); err != nil {
+    return err
+  }
   header.Vendor_string = string(buffer.Next(int(length)))
 
-  binary.Read(buffer, binary.LittleEndian, &length)
+  if binary.Read(buffer, binary.LittleEndian, &length) != nil || int64(length) > int64(buffer.Len()/4) {
+    return commentError("comment count", ErrTruncatedHeader)
+  }
+  // Each comment's length counts towards the limit too
+  if err := take("comment count", 4*length); err != nil {
+    return err
+  }
   header.User_comments = make([]string, length)
   for i := range header.User_comments {
-    binary.Read(buffer, binary.LittleEndian, &length)
+    if binary.Read(buffer, binary.LittleEndian, &length) != nil || int64(length) > int64(buffer.Len()) {
+      return commentError("comment", ErrTruncatedHeader)
+    }
+    if err := take("comment", length); err != nil {
+      return err
+    }
     header.User_comments[i] = string(buffer.Next(int(length)))
   }
 
-  framing, _ := buffer.ReadByte()
+  framing, err := buffer.ReadByte()
+  if err != nil {
+    return commentError("framing bit", ErrTruncatedHeader)
+  }
   header.Framing = (framing & 0x1) != 0
   if !header.Framing {
-    panic("Framing bit not set in comment header")
+    return commentError("framing bit", ErrFraming)
   }
+  return nil
 }
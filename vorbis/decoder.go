@@ -0,0 +1,441 @@
+package vorbis
+
+import (
+  "errors"
+  "io"
+  "math"
+  "ogg"
+)
+
+// Info holds the fields of a stream's id header.  Bitrates are in bits per
+// second, and are 0 if the encoder didn't set them.
+type Info struct {
+  Channels        int
+  Sample_rate     int
+  Bitrate_maximum int
+  Bitrate_nominal int
+  Bitrate_minimum int
+  Blocksize_0     int
+  Blocksize_1     int
+}
+
+// A Decoder reads the first Vorbis stream in an Ogg file and returns its
+// samples interleaved, so a stereo stream gives left, right, left, right...
+// As the spec says, the granule positions of the first and last pages decide
+// where the stream starts and ends, so it is exactly as long as ReadLength
+// says it is.
+type Decoder struct {
+  in      io.Reader
+  options ogg.Options
+  packets *ogg.PacketReader
+  v       vorbisDecoder
+  info    Info
+
+  // The number of packets before the first audio packet
+  header_packets int
+
+  // Samples that have been decoded but not read yet, pending[channel][sample]
+  pending [][]float64
+
+  // The position of the next sample to be read
+  position int64
+
+  // Granule positions aren't known until the first audio page with one has
+  // been decoded.  After that granule is the granule position of the end of
+  // pending, and begin is the granule position of the first sample of the
+  // stream.  Samples are only read once pending ends on a page's granule
+  // position, since the last page can cut off any of the samples on it.
+  started    bool
+  granule    int64
+  begin      int64
+  at_granule bool
+
+  err error
+}
+
+// NewDecoder reads the headers of the first Vorbis stream in in and returns a
+// Decoder that's ready to read its samples.  Bitstreams of other formats,
+// such as the video of a Theora file, are skipped.  If the headers aren't
+// valid the error is a *HeaderError saying what's wrong with them.
+func NewDecoder(in io.Reader) (*Decoder, error) {
+  return NewDecoderWithOptions(in, ogg.Options{})
+}
+
+// NewDecoderWithOptions is the same as NewDecoder, except that options
+// control how damaged pages are handled and the limits the stream is held to.
+func NewDecoderWithOptions(in io.Reader, options ogg.Options) (*Decoder, error) {
+  return newDecoder(in, options, isVorbis)
+}
+
+// NewDecoderForSerial decodes the bitstream with the given serial number,
+// which is how to pick one of several Vorbis streams in the same file, for
+// example one language of a film found with an ogg.Demuxer.
+func NewDecoderForSerial(in io.Reader, serial uint32, options ogg.Options) (*Decoder, error) {
+  return newDecoder(in, options, func(stream ogg.Bitstream) bool {
+    return stream.Serial == serial
+  })
+}
+
+// isVorbis picks bitstreams that start with a Vorbis id header
+func isVorbis(stream ogg.Bitstream) bool {
+  return len(stream.First) >= len(magic_string) && string(stream.First[0:len(magic_string)]) == magic_string
+}
+
+func newDecoder(in io.Reader, options ogg.Options, choose func(stream ogg.Bitstream) bool) (*Decoder, error) {
+  var d Decoder
+  d.in = in
+  d.options = options
+  d.v.limits = options.Limits
+  d.packets = ogg.NewPacketReaderChoosing(in, options, choose)
+  for d.v.mode != readData {
+    packet, err := d.packets.ReadPacket()
+    if err == io.EOF && d.header_packets == 0 {
+      return nil, idError("bitstream", ErrNotVorbis)
+    }
+    if err == io.EOF {
+      err = io.ErrUnexpectedEOF
+    }
+    if err != nil {
+      return nil, err
+    }
+    if _, err := d.v.readPacket(packet.Data); err != nil {
+      return nil, err
+    }
+    d.header_packets++
+  }
+  d.info = Info{
+    Channels:        int(d.v.Channels),
+    Sample_rate:     int(d.v.Sample_rate),
+    Bitrate_maximum: int(int32(d.v.Bitrate_maximum)),
+    Bitrate_nominal: int(int32(d.v.Bitrate_nominal)),
+    Bitrate_minimum: int(int32(d.v.Bitrate_minimum)),
+    Blocksize_0:     d.v.Blocksize_0,
+    Blocksize_1:     d.v.Blocksize_1,
+  }
+  return &d, nil
+}
+
+func (d *Decoder) Info() Info {
+  return d.info
+}
+
+// next makes sure that there is at least one sample pending for each channel,
+// decoding packets until there is.  Everything up to the next packet with a
+// granule position is decoded at once, so that samples the first page says
+// aren't part of the stream can be dropped from the start and samples after
+// the last page's granule position can be dropped from the end.
+func (d *Decoder) next() error {
+  for d.err == nil && (d.pending == nil || len(d.pending[0]) == 0 || !d.at_granule) {
+    var packet ogg.Packet
+    packet, d.err = d.packets.ReadPacket()
+    var samples [][]float64
+    if d.err == nil {
+      samples, d.err = d.v.readPacket(packet.Data)
+    }
+    if d.err != nil {
+      break
+    }
+    if samples != nil {
+      if d.pending == nil {
+        d.pending = make([][]float64, len(samples))
+      }
+      for ch := range samples {
+        d.pending[ch] = append(d.pending[ch], samples[ch]...)
+      }
+      d.granule += int64(len(samples[0]))
+    }
+    d.at_granule = packet.Granule_position != ogg.NoGranulePosition
+    if d.at_granule {
+      d.trim(int64(packet.Granule_position), packet.Eos)
+    }
+  }
+  if d.pending != nil && len(d.pending[0]) > 0 {
+    return nil
+  }
+  return d.err
+}
+
+// trim lines up the pending samples with the granule position of the page
+// the last packet ended on.  The first such page says how many of the samples
+// before it are part of the stream, and the last page says where the stream
+// ends, which is usually part way through its last packet.  Only the samples
+// still pending can be dropped.
+func (d *Decoder) trim(granule_position int64, eos bool) {
+  if !d.started {
+    d.started = true
+    d.begin = granule_position - d.granule
+    if d.begin >= 0 {
+      d.granule = granule_position
+    } else {
+      // If the only page with a granule position is the last one there's
+      // no telling where the stream started, so only the end is trimmed.
+      d.begin = 0
+      if !eos {
+        d.dropFront(d.granule - granule_position)
+        d.granule = granule_position
+      }
+    }
+  }
+  if eos && d.granule > granule_position {
+    d.dropBack(d.granule - granule_position)
+  }
+  d.granule = granule_position
+}
+
+// dropFront and dropBack throw away up to n pending samples of each channel
+func (d *Decoder) dropFront(n int64) {
+  if d.pending == nil {
+    return
+  }
+  if n > int64(len(d.pending[0])) {
+    n = int64(len(d.pending[0]))
+  }
+  for ch := range d.pending {
+    d.pending[ch] = d.pending[ch][n:]
+  }
+}
+
+func (d *Decoder) dropBack(n int64) {
+  if d.pending == nil {
+    return
+  }
+  if n > int64(len(d.pending[0])) {
+    n = int64(len(d.pending[0]))
+  }
+  for ch := range d.pending {
+    d.pending[ch] = d.pending[ch][0 : int64(len(d.pending[ch]))-n]
+  }
+}
+
+// read calls write for as many samples as will fit in a buffer of size n and
+// returns the number of values written.
+func (d *Decoder) read(n int, write func(i int, sample float64)) (int, error) {
+  channels := d.info.Channels
+  if n < channels {
+    return 0, io.ErrShortBuffer
+  }
+  written := 0
+  for written+channels <= n {
+    if err := d.next(); err != nil {
+      if written > 0 {
+        return written, nil
+      }
+      return 0, err
+    }
+    frames := len(d.pending[0])
+    if space := (n - written) / channels; frames > space {
+      frames = space
+    }
+    for ch := range d.pending {
+      for j, sample := range d.pending[ch][0:frames] {
+        write(written+j*channels+ch, sample)
+      }
+      d.pending[ch] = d.pending[ch][frames:]
+    }
+    d.position += int64(frames)
+    written += frames * channels
+  }
+  return written, nil
+}
+
+// ReadFloat32 fills p with interleaved samples in the range [-1, 1] and
+// returns the number of values written, which is always a multiple of the
+// number of channels.  At the end of the stream it returns io.EOF.
+func (d *Decoder) ReadFloat32(p []float32) (int, error) {
+  return d.read(len(p), func(i int, sample float64) {
+    p[i] = float32(sample)
+  })
+}
+
+// ReadInt16 is the same as ReadFloat32, except that samples are scaled to
+// the full range of an int16 and clipped.
+func (d *Decoder) ReadInt16(p []int16) (int, error) {
+  return d.read(len(p), func(i int, sample float64) {
+    v := math.Floor(sample*32768 + 0.5)
+    if v > 32767 {
+      v = 32767
+    }
+    if v < -32768 {
+      v = -32768
+    }
+    p[i] = int16(v)
+  })
+}
+
+// Seek moves the decoder so that the next sample read is the one at the
+// given position, which is in samples per channel rather than bytes.  whence
+// is 0 to count from the first sample of the stream, 1 to count from the
+// current position or 2 to count from the end of the stream, just like
+// io.Seeker.  It returns the new position.
+//
+// The samples read after a seek are exactly the same as the ones that would
+// have been read by decoding the whole stream up to that point.  Seeking past
+// the end of the stream isn't an error, the next read just returns io.EOF.
+// The decoder must have been made with an io.ReadSeeker.
+func (d *Decoder) Seek(offset int64, whence int) (int64, error) {
+  rs, ok := d.in.(io.ReadSeeker)
+  if !ok {
+    return d.position, errors.New("Seek needs an io.ReadSeeker")
+  }
+  // Sample positions are counted from the start of the stream, which might
+  // not be granule position 0.
+  if !d.started {
+    if err := d.next(); err != nil && err != io.EOF {
+      return d.position, err
+    }
+  }
+  sample := offset
+  switch whence {
+  case 0:
+  case 1:
+    sample += d.position
+  case 2:
+    end, err := d.end(rs)
+    if err != nil {
+      return d.position, err
+    }
+    sample += end
+  default:
+    return d.position, errors.New("Seek only supports whence of 0, 1 or 2")
+  }
+  if sample < 0 {
+    return d.position, errors.New("Seek to a negative sample")
+  }
+  err := d.seek(rs, sample)
+  if err != nil {
+    return d.position, err
+  }
+  d.position = sample
+  return sample, nil
+}
+
+// end returns the number of samples in the stream, from the granule position
+// of its last page.  rs is left where it was.
+func (d *Decoder) end(rs io.ReadSeeker) (int64, error) {
+  current, err := rs.Seek(0, 1)
+  if err != nil {
+    return 0, err
+  }
+  granule, err := ogg.LastGranule(rs, d.packets.Serial())
+  if _, seek_err := rs.Seek(current, 0); err == nil {
+    err = seek_err
+  }
+  if err != nil {
+    return 0, err
+  }
+  return int64(granule) - d.begin, nil
+}
+
+func (d *Decoder) seek(rs io.ReadSeeker, sample int64) error {
+  // Decoding has to start with a packet whose end position is known and no
+  // later than sample, since that packet only primes the overlap-add.  Pages
+  // give the end position of the last packet that ends on them, so we look
+  // for one a little before sample and look further back if that doesn't
+  // work out.
+  target := d.begin + sample
+  back := int64(2 * d.info.Blocksize_1)
+  for sample-back > 0 {
+    _, err := ogg.SeekGranule(rs, d.packets.Serial(), uint64(target-back))
+    if err == io.EOF {
+      d.pending = nil
+      d.err = io.EOF
+      return nil
+    }
+    if err != nil {
+      return err
+    }
+    packets := ogg.NewPacketReaderAt(rs, d.packets.Serial(), d.options)
+    found, err := d.preroll(packets, target)
+    if err != nil {
+      return err
+    }
+    if found {
+      return nil
+    }
+    back *= 2
+  }
+
+  // sample is so close to the start that it's simplest to just decode from
+  // the beginning.
+  if _, err := rs.Seek(0, 0); err != nil {
+    return err
+  }
+  serial := d.packets.Serial()
+  packets := ogg.NewPacketReaderChoosing(rs, d.options, func(stream ogg.Bitstream) bool {
+    return stream.Serial == serial
+  })
+  for i := 0; i < d.header_packets; i++ {
+    if _, err := packets.ReadPacket(); err != nil {
+      return err
+    }
+  }
+  d.packets = packets
+  d.v.previous = nil
+  d.pending = nil
+  d.err = nil
+  d.started = false
+  d.granule = 0
+  d.at_granule = false
+  return d.skipTo(0, sample)
+}
+
+// preroll reads packets until it finds one with a known end position, which
+// is the last packet to end on a page.  If that is no later than the granule
+// position target it decodes from there and skips up to target, otherwise it
+// returns false.
+func (d *Decoder) preroll(packets *ogg.PacketReader, target int64) (bool, error) {
+  for {
+    packet, err := packets.ReadPacket()
+    if err == io.EOF {
+      return false, nil
+    }
+    if err != nil {
+      return false, err
+    }
+    if packet.Granule_position == ogg.NoGranulePosition {
+      continue
+    }
+    position := int64(packet.Granule_position)
+    if position > target {
+      return false, nil
+    }
+    // The packet only primes the overlap, the samples that follow it start
+    // at its end position.
+    d.packets = packets
+    d.v.previous = nil
+    d.v.readAudioPacket(packet.Data, d.info.Channels)
+    d.pending = nil
+    d.err = nil
+    d.started = true
+    d.granule = position
+    d.at_granule = true
+    return true, d.skipTo(position, target)
+  }
+}
+
+// skipTo throws away samples until the next one read is at target, position
+// is the position of the first pending sample.
+func (d *Decoder) skipTo(position, target int64) error {
+  for {
+    if d.pending != nil && len(d.pending[0]) > 0 {
+      n := int64(len(d.pending[0]))
+      skip := n
+      if position+n > target {
+        skip = target - position
+      }
+      for ch := range d.pending {
+        d.pending[ch] = d.pending[ch][skip:]
+      }
+      position += skip
+      if position == target {
+        return nil
+      }
+    }
+    if err := d.next(); err != nil {
+      if err == io.EOF {
+        return nil
+      }
+      return err
+    }
+  }
+}
@@ -0,0 +1,63 @@
+package vorbis
+
+import (
+  "errors"
+  "fmt"
+)
+
+// The kinds of problem that can be found in the headers of a Vorbis stream.
+// Header errors returned by this package are *HeaderErrors, which match one
+// of these with errors.Is.
+var (
+  ErrNotVorbis       = errors.New("Not a Vorbis header")
+  ErrVersion         = errors.New("Unsupported Vorbis version")
+  ErrFraming         = errors.New("Framing bit not set")
+  ErrInvalidValue    = errors.New("Invalid value")
+  ErrBlocksize       = errors.New("Invalid blocksize")
+  ErrOutOfRange      = errors.New("Index out of range")
+  ErrReserved        = errors.New("Reserved value used")
+  ErrCodebookSync    = errors.New("Codebook sync pattern not found")
+  ErrCodebook        = errors.New("Invalid codebook")
+  ErrTruncatedHeader = errors.New("Header ended early")
+)
+
+// A HeaderError describes what is wrong with one of the headers.  Header is
+// "id", "comment" or "setup", and Field says what was being read.
+type HeaderError struct {
+  Header string
+  Field  string
+  Err    error
+}
+
+func (e *HeaderError) Error() string {
+  return fmt.Sprintf("Invalid %s header, %s: %s.", e.Header, e.Field, e.Err.Error())
+}
+
+func (e *HeaderError) Unwrap() error {
+  return e.Err
+}
+
+func idError(field string, err error) error {
+  return &HeaderError{"id", field, err}
+}
+
+func commentError(field string, err error) error {
+  return &HeaderError{"comment", field, err}
+}
+
+func setupError(field string, err error) error {
+  return &HeaderError{"setup", field, err}
+}
+
+// within adds where in the setup header an error was found to its field, for
+// example which of the mappings it was in.
+func within(where string, err error) error {
+  if e, ok := err.(*HeaderError); ok {
+    e.Field = where + " " + e.Field
+  }
+  return err
+}
+
+// errInvalidCodeword is set on a BitReader when a codeword doesn't match any
+// entry of its codebook, which is treated the same as the packet ending.
+var errInvalidCodeword = errors.New("Invalid codeword")
@@ -0,0 +1,198 @@
+package vorbis
+
+import (
+  "bytes"
+  "io"
+  "ogg"
+)
+
+// InverseMDCT exposes the inverse MDCT to the specs in package vorbis_test.
+func InverseMDCT(in []float64) []float64 {
+  out := make([]float64, 2*len(in))
+  makeIMDCT(2*len(in)).inverse(in, out)
+  return out
+}
+
+// Window returns the precomputed window for a block.
+func Window(blocksize_0, blocksize_1 int, long, prev, next bool) []float64 {
+  var v vorbisDecoder
+  v.Blocksize_0 = blocksize_0
+  v.Blocksize_1 = blocksize_1
+  v.prepare()
+  if !long {
+    return v.windows[0][0][0]
+  }
+  return v.windows[1][boolToInt(prev)][boolToInt(next)]
+}
+
+// Synthesize runs the inverse MDCT, windowing and overlap-add stages of the
+// decoder over a sequence of mono blocks and returns all of the finished
+// samples.
+func Synthesize(blocksize_0, blocksize_1 int, long []bool, spectra [][]float64) []float64 {
+  var v vorbisDecoder
+  v.Blocksize_0 = blocksize_0
+  v.Blocksize_1 = blocksize_1
+  v.prepare()
+  var output []float64
+  for i := range spectra {
+    window := v.windows[0][0][0]
+    if long[i] {
+      prev := i > 0 && long[i-1]
+      next := i < len(long)-1 && long[i+1]
+      window = v.windows[1][boolToInt(prev)][boolToInt(next)]
+    }
+    samples := v.synthesize([][]float64{spectra[i]}, window)
+    if samples != nil {
+      output = append(output, samples[0]...)
+    }
+  }
+  return output
+}
+
+func boolToInt(b bool) int {
+  if b {
+    return 1
+  }
+  return 0
+}
+
+// DecodeFloor reads the id and setup headers and then decodes a single floor
+// from the start of packet, for a spectrum of size n.
+func DecodeFloor(id, setup, packet []byte, floor, n int) []float64 {
+  var v vorbisDecoder
+  v.idHeader.read(bytes.NewBuffer(id), ogg.DefaultLimits)
+  v.setupHeader.read(bytes.NewBuffer(setup), int(v.Channels), ogg.DefaultLimits)
+  v.prepare()
+  return v.Floor_configs[floor].Decode(MakeBitReader(packet), v.Codebooks, n)
+}
+
+// DecodeSpectra reads the id and setup headers and then decodes the spectrum
+// of each channel in packet.  It also returns false if the packet should be
+// discarded.
+func DecodeSpectra(id, setup, packet []byte) ([][]float64, bool) {
+  var v vorbisDecoder
+  v.idHeader.read(bytes.NewBuffer(id), ogg.DefaultLimits)
+  v.setupHeader.read(bytes.NewBuffer(setup), int(v.Channels), ogg.DefaultLimits)
+  v.prepare()
+  spectra, window := v.decodeSpectra(MakeBitReader(packet), int(v.Channels))
+  return spectra, window != nil
+}
+
+// DecodeResidue reads the id and setup headers and then decodes a single
+// residue from the start of packet, for len(do_not_decode) vectors of size n.
+func DecodeResidue(id, setup, packet []byte, residue int, do_not_decode []bool, n int) [][]float64 {
+  var v vorbisDecoder
+  v.idHeader.read(bytes.NewBuffer(id), ogg.DefaultLimits)
+  v.setupHeader.read(bytes.NewBuffer(setup), int(v.Channels), ogg.DefaultLimits)
+  v.prepare()
+  br := MakeBitReader(packet)
+  return v.Residue_configs[residue].Decode(br, v.Codebooks, len(do_not_decode), do_not_decode, n)
+}
+
+// ReadCodebook reads a single codebook header from data
+func ReadCodebook(data []byte) *Codebook {
+  var book Codebook
+  book.decode(MakeBitReader(data), &setupBudget{limits: ogg.DefaultLimits})
+  return &book
+}
+
+// ReadIdHeader, ReadCommentHeader and ReadSetupHeader run a single header
+// reader, the setup header needs the channel count from an id header.
+func ReadIdHeader(data []byte) error {
+  var header idHeader
+  return header.read(bytes.NewBuffer(data), ogg.DefaultLimits)
+}
+
+func ReadCommentHeader(data []byte) error {
+  var header commentHeader
+  return header.read(bytes.NewBuffer(data), ogg.DefaultLimits)
+}
+
+func ReadSetupHeader(id, setup []byte) error {
+  var v vorbisDecoder
+  if err := v.idHeader.read(bytes.NewBuffer(id), ogg.DefaultLimits); err != nil {
+    return err
+  }
+  return v.setupHeader.read(bytes.NewBuffer(setup), int(v.Channels), ogg.DefaultLimits)
+}
+
+// DecodePackets reads the id and setup headers and then decodes each of the
+// audio packets, returning how many samples per channel came out.
+func DecodePackets(id, setup []byte, packets ...[]byte) (int, error) {
+  var v vorbisDecoder
+  if err := v.idHeader.read(bytes.NewBuffer(id), ogg.DefaultLimits); err != nil {
+    return 0, err
+  }
+  if err := v.setupHeader.read(bytes.NewBuffer(setup), int(v.Channels), ogg.DefaultLimits); err != nil {
+    return 0, err
+  }
+  v.prepare()
+  v.mode = readData
+  n := 0
+  for _, packet := range packets {
+    samples, err := v.readPacket(packet)
+    if err != nil {
+      return n, err
+    }
+    if samples != nil {
+      n += len(samples[0])
+    }
+  }
+  return n, nil
+}
+
+// ByteBitReader is the BitReader as it was when it read one byte at a time
+// through an io.ByteReader.  It's only kept so that benchmarks can compare
+// against it.
+type ByteBitReader struct {
+  in      io.ByteReader
+  current byte
+  bit_pos int
+  err     error
+}
+
+func MakeByteBitReader(in io.ByteReader) *ByteBitReader {
+  var br ByteBitReader
+  br.in = in
+  br.bit_pos = 8
+  return &br
+}
+
+func (br *ByteBitReader) readAtMost(n int) (read int, bits uint32) {
+  if br.bit_pos == 8 {
+    var err error
+    br.current, err = br.in.ReadByte()
+    if err != nil {
+      br.err = err
+      return n, 0
+    }
+    br.bit_pos = 0
+  }
+  bits = uint32(br.current)
+  bits = bits >> uint(br.bit_pos)
+  bits = bits & ((1 << uint(n)) - 1)
+  read = 8 - br.bit_pos
+  if read > n {
+    read = n
+  }
+  br.bit_pos += read
+  return
+}
+
+func (br *ByteBitReader) ReadBits(n int) uint32 {
+  if br.err != nil {
+    return 0
+  }
+  var bits uint32
+  pos := 0
+  for n > 0 {
+    read, next := br.readAtMost(n)
+    if br.err != nil {
+      return 0
+    }
+    bits = bits | (next << uint(pos))
+    pos += read
+    n -= read
+  }
+  return bits
+}
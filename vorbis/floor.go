@@ -1,6 +1,9 @@
 package vorbis
 
-import "sort"
+import (
+  "math"
+  "sort"
+)
 
 var inverse_db_table []float64
 
@@ -278,68 +281,146 @@ type Floor0 struct {
   amplitude_offset int
 
   books []int
+
+  // Maps from spectrum index to bark scale, keyed by the size of the
+  // spectrum.  These are filled in by generateBarkMaps once the block sizes
+  // are known.
+  bark_maps map[int][]int
 }
 
-// TODO: Floor0 is not done, but should be completed prior to release
-// TODO: Need to find a vorbis file that actually uses floor0 for testing
 func (f *Floor0) Decode(br *BitReader, codebooks []Codebook, n int) []float64 {
-  panic("Floor0 not complete: notify devs")
   amplitude := int(br.ReadBits(f.amplitude_bits))
-  if amplitude > 0 {
-    var coefficient []float64
-    book_num := ilog(uint32(len(f.books)))
-    if book_num >= len(f.books) {
-      panic("Floor codebook index out of range.")
+  if amplitude == 0 {
+    return nil
+  }
+
+  book_num := int(br.ReadBits(ilog(uint32(len(f.books)))))
+  if book_num >= len(f.books) {
+    // The packet is undecodable, the same as if the packet had ended here.
+    return nil
+  }
+  book := codebooks[f.books[book_num]]
+  var coefficients []float64
+  last := 0.0
+  for len(coefficients) < f.order {
+    temp := book.DecodeVector(br)
+    if temp == nil {
+      // The packet ended early
+      return nil
+    }
+    for _, v := range temp {
+      coefficients = append(coefficients, v+last)
     }
-    book := codebooks[f.books[book_num]]
-    last := 0.0
-    for len(coefficient) < f.order {
-      temp := book.DecodeVector(br)
-      for _, v := range temp {
-        coefficient = append(coefficient, v+last)
+    last = coefficients[len(coefficients)-1]
+  }
+
+  return f.computeCurve(amplitude, coefficients[0:f.order], n)
+}
+
+func bark(x float64) float64 {
+  return 13.1*math.Atan(0.00074*x) + 2.24*math.Atan(0.0000000185*x*x) + 0.0001*x
+}
+
+// generateBarkMaps precomputes the bark maps needed for spectra of each of
+// the sizes in ns.
+func (f *Floor0) generateBarkMaps(ns ...int) {
+  f.bark_maps = make(map[int][]int)
+  for _, n := range ns {
+    bark_map := make([]int, n)
+    scale := float64(f.bark_map_size) / bark(0.5*float64(f.rate))
+    for i := range bark_map {
+      v := int(math.Floor(bark(float64(f.rate*i)/float64(2*n)) * scale))
+      if v > f.bark_map_size-1 {
+        v = f.bark_map_size - 1
       }
-      last = coefficient[len(coefficient)-1]
+      bark_map[i] = v
     }
+    f.bark_maps[n] = bark_map
+  }
+}
 
-    // This is acceptable according to the spec, so we try to proceed and
-    // avoid panicing
-    if br.CheckError() != nil {
-      return nil
+// computeCurve synthesizes the floor curve from the LSP coefficients.
+func (f *Floor0) computeCurve(amplitude int, coefficients []float64, n int) []float64 {
+  bark_map := f.bark_maps[n]
+  cos_coefficients := make([]float64, len(coefficients))
+  for i := range coefficients {
+    cos_coefficients[i] = math.Cos(coefficients[i])
+  }
+  max_amplitude := float64(int(1)<<uint(f.amplitude_bits) - 1)
+
+  curve := make([]float64, n)
+  i := 0
+  for i < n {
+    omega := math.Pi * float64(bark_map[i]) / float64(f.bark_map_size)
+    cos_omega := math.Cos(omega)
+
+    var p, q float64
+    if f.order%2 == 1 {
+      p = 1 - cos_omega*cos_omega
+      q = 0.25
+    } else {
+      p = (1 - cos_omega) / 2
+      q = (1 + cos_omega) / 2
+    }
+    for j := 1; j < f.order; j += 2 {
+      d := cos_coefficients[j] - cos_omega
+      p *= 4 * d * d
+    }
+    for j := 0; j < f.order; j += 2 {
+      d := cos_coefficients[j] - cos_omega
+      q *= 4 * d * d
+    }
+
+    linear_floor_value := math.Exp(0.11512925 * (float64(amplitude*f.amplitude_offset)/(max_amplitude*math.Sqrt(p+q)) - float64(f.amplitude_offset)))
+
+    // Every element that maps to the same bark value gets the same value
+    current := bark_map[i]
+    for i < n && bark_map[i] == current {
+      curve[i] = linear_floor_value
+      i++
     }
-    return coefficient[0:f.order]
   }
-  return nil
+  return curve
 }
 
-func readFloor(br *BitReader, num_codebooks int) Floor {
+func readFloor(br *BitReader, codebooks []Codebook) (Floor, error) {
   floor_type := int(br.ReadBits(16))
   switch floor_type {
   case 0:
-    return decodeFloor0(br, num_codebooks)
+    return decodeFloor0(br, codebooks)
   case 1:
-    return decodeFloor1(br)
-  default:
-    panic("Unknown floor type.")
+    return decodeFloor1(br, len(codebooks))
   }
-  return nil
+  return nil, setupError("floor type", ErrReserved)
 }
 
-func decodeFloor0(br *BitReader, max_books int) Floor {
+func decodeFloor0(br *BitReader, codebooks []Codebook) (Floor, error) {
   var f Floor0
   f.order = int(br.ReadBits(8))
   f.rate = int(br.ReadBits(16))
   f.bark_map_size = int(br.ReadBits(16))
   f.amplitude_bits = int(br.ReadBits(6))
   f.amplitude_offset = int(br.ReadBits(8))
+  if f.order == 0 || f.rate == 0 || f.bark_map_size == 0 {
+    return nil, setupError("floor 0 parameters", ErrInvalidValue)
+  }
   num_books := int(br.ReadBits(4) + 1)
   f.books = make([]int, num_books)
   for i := range f.books {
     f.books[i] = int(br.ReadBits(8))
-    if f.books[i] < 0 || f.books[i] >= max_books {
-      panic("Invalid codebook specified in Floor0 decode.")
+    if f.books[i] < 0 || f.books[i] >= len(codebooks) {
+      return nil, setupError("floor 0 book", ErrOutOfRange)
+    }
+    // The coefficients are decoded as vectors, so the book has to have some
+    book := &codebooks[f.books[i]]
+    if book.Value_vectors == nil || book.Dimensions == 0 {
+      return nil, setupError("floor 0 book without value vectors", ErrInvalidValue)
     }
   }
-  return &f
+  if br.CheckError() != nil {
+    return nil, setupError("floor 0 books", ErrTruncatedHeader)
+  }
+  return &f, nil
 }
 
 type Floor1 struct {
@@ -367,8 +448,10 @@ func (f *Floor1) Decode(br *BitReader, codebooks []Codebook, n int) []float64 {
   }
 
   // Decode Y values
+  // The spec says that if the packet ends during this the floor is unused,
+  // just as if the non-zero bit wasn't set.
   Ys := f.decodeYs(br, codebooks)
-  if Ys == nil {
+  if br.CheckError() != nil {
     return nil
   }
 
@@ -485,7 +568,13 @@ func (f *Floor1) computeCurve(br *BitReader, Ys []int, codebooks []Codebook, n i
   lx := 0
   ly := final_Ys[0] * f.multiplier
 
-  floor := make([]int, n)
+  // The last X value can be past the end of the spectrum, in which case the
+  // curve is truncated
+  size := n
+  if Xs[len(Xs)-1] > size {
+    size = Xs[len(Xs)-1]
+  }
+  floor := make([]int, size)
   var hy int
   for i := 1; i < len(final_Ys); i++ {
     if step_2[i] {
@@ -503,9 +592,18 @@ func (f *Floor1) computeCurve(br *BitReader, Ys []int, codebooks []Codebook, n i
   } else if hx > n {
     floor = floor[0:n]
   }
+  // A damaged stream can push the curve out of the range of the table, the
+  // spec asks for it to be clamped.
   amps := make([]float64, n)
   for i := range amps {
-    amps[i] = inverse_db_table[floor[i]]
+    y := floor[i]
+    if y < 0 {
+      y = 0
+    }
+    if y > 255 {
+      y = 255
+    }
+    amps[i] = inverse_db_table[y]
   }
   return amps
 }
@@ -527,7 +625,7 @@ func (c *curveVals) Less(i, j int) bool {
   return c.X[i] < c.X[j]
 }
 
-func decodeFloor1(br *BitReader) Floor {
+func decodeFloor1(br *BitReader, max_books int) (Floor, error) {
   var f Floor1
 
   num_partitions := int(br.ReadBits(5))
@@ -547,11 +645,17 @@ func decodeFloor1(br *BitReader) Floor {
     class.subclass = int(br.ReadBits(2))
     if class.subclass > 0 {
       class.masterbook = int(br.ReadBits(8))
+      if class.masterbook >= max_books {
+        return nil, setupError("floor 1 masterbook", ErrOutOfRange)
+      }
     }
     class.subclass_books = make([]int, int(1<<uint(class.subclass)))
     for j := 0; j < int(1<<uint(class.subclass)); j++ {
       // 12
-      class.subclass_books[j] = int(br.ReadBits(8) - 1)
+      class.subclass_books[j] = int(br.ReadBits(8)) - 1
+      if class.subclass_books[j] >= max_books {
+        return nil, setupError("floor 1 subclass book", ErrOutOfRange)
+      }
     }
   }
 
@@ -565,5 +669,21 @@ func decodeFloor1(br *BitReader) Floor {
       f.Xs = append(f.Xs, int(br.ReadBits(rangebits)))
     }
   }
-  return &f
+  if br.CheckError() != nil {
+    return nil, setupError("floor 1 X values", ErrTruncatedHeader)
+  }
+
+  // The curve is drawn between neighbouring X values, so they have to be
+  // different.  The spec also limits how many there can be.
+  if len(f.Xs) > 65 {
+    return nil, setupError("floor 1 X values", ErrInvalidValue)
+  }
+  seen := make(map[int]bool)
+  for _, x := range f.Xs {
+    if seen[x] {
+      return nil, setupError("floor 1 X values", ErrInvalidValue)
+    }
+    seen[x] = true
+  }
+  return &f, nil
 }
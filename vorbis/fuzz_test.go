@@ -0,0 +1,269 @@
+package vorbis_test
+
+import (
+  . "gospec"
+  "gospec"
+  "ogg"
+  "ogg/vorbis"
+  "bytes"
+  "errors"
+  "flag"
+  "io"
+  "io/ioutil"
+  "math/rand"
+  "path/filepath"
+  "testing"
+)
+
+// Each stream in testdata/bad_headers has Ogg framing that's fine but
+// Vorbis headers that are wrong in one particular way, so between them they
+// reach most of the ways header parsing can fail.  They're built from the
+// synthetic headers in synthetic_test.go rather than from a real file, since
+// most of these mistakes can't be made by editing an encoded setup header a
+// byte at a time.  -update_headers rewrites them from bad_header_streams.
+var update_headers = flag.Bool("update_headers", false, "Rebuild the streams in testdata/bad_headers")
+
+// A badHeaderStream is the packets of a stream along with the error that
+// NewDecoder should give for it.  err is matched with errors.Is, and nil
+// means that the headers are fine and the whole stream can be decoded.
+type badHeaderStream struct {
+  name    string
+  packets func() [][]byte
+  err     error
+}
+
+// badSetupStream puts the given setup header after a valid id and comment
+// header.
+func badSetupStream(setup []byte) [][]byte {
+  return [][]byte{
+    syntheticIdHeader(1, 44100, 64, 64),
+    syntheticCommentHeader("vendor", "TITLE=test"),
+    setup,
+  }
+}
+
+// editedSetupStream puts simpleSetup, after edit has changed it, after a valid
+// id and comment header.
+func editedSetupStream(edit func(s *syntheticSetup)) [][]byte {
+  s := simpleSetup()
+  edit(&s)
+  return badSetupStream(s.Bytes())
+}
+
+var bad_header_streams = []badHeaderStream{
+  {"oversized-codebook.ogg", func() [][]byte {
+    return badSetupStream(hugeCodebookSetup())
+  }, ogg.ErrLimitExceeded},
+
+  {"bad-mapping-floor.ogg", func() [][]byte {
+    return editedSetupStream(func(s *syntheticSetup) {
+      s.mappings[0] = func(w *bitWriter) {
+        w.Write(0, 16)
+        w.WriteBool(false)
+        w.WriteBool(false)
+        w.Write(0, 2)
+        w.Write(0, 8)
+        w.Write(1, 8)
+        w.Write(0, 8)
+      }
+    })
+  }, vorbis.ErrOutOfRange},
+
+  {"bad-mode-mapping.ogg", func() [][]byte {
+    return editedSetupStream(func(s *syntheticSetup) {
+      s.modes[0].mapping = 1
+    })
+  }, vorbis.ErrOutOfRange},
+
+  {"bad-blocksize.ogg", func() [][]byte {
+    packets := editedSetupStream(func(s *syntheticSetup) {})
+    packets[0] = syntheticIdHeader(1, 44100, 128, 64)
+    return packets
+  }, vorbis.ErrBlocksize},
+
+  {"truncated-setup.ogg", func() [][]byte {
+    s := simpleSetup()
+    setup := s.Bytes()
+    return badSetupStream(setup[0 : len(setup)/2])
+  }, vorbis.ErrTruncatedHeader},
+
+  {"overspecified-codebook.ogg", func() [][]byte {
+    return editedSetupStream(func(s *syntheticSetup) {
+      s.codebooks[0].lengths = []int{1, 1, 1}
+    })
+  }, vorbis.ErrCodebook},
+
+  {"missing-codebook-sync.ogg", func() [][]byte {
+    s := simpleSetup()
+    setup := s.Bytes()
+    setup[8] = 0
+    return badSetupStream(setup)
+  }, vorbis.ErrCodebookSync},
+
+  {"huge-comment-count.ogg", func() [][]byte {
+    packets := editedSetupStream(func(s *syntheticSetup) {})
+    comment := syntheticCommentHeader("vendor")
+    copy(comment[17:21], []byte{0xff, 0xff, 0xff, 0x7f})
+    packets[1] = comment
+    return packets
+  }, vorbis.ErrTruncatedHeader},
+
+  {"reserved-floor-type.ogg", func() [][]byte {
+    return editedSetupStream(func(s *syntheticSetup) {
+      s.floors[0] = func(w *bitWriter) {
+        w.Write(2, 16)
+      }
+    })
+  }, vorbis.ErrReserved},
+
+  {"residue-end-before-begin.ogg", func() [][]byte {
+    return editedSetupStream(func(s *syntheticSetup) {
+      s.residues[0] = func(w *bitWriter) {
+        w.Write(0, 16)
+        w.Write(8, 24)
+        w.Write(0, 24)
+        w.Write(0, 24)
+        w.Write(0, 6)
+        w.Write(0, 8)
+        w.Write(0, 3)
+        w.WriteBool(false)
+      }
+    })
+  }, vorbis.ErrInvalidValue},
+
+  // Valid headers followed by one valid audio packet and then random ones,
+  // which should decode to something without any errors.
+  {"garbage-audio.ogg", func() [][]byte {
+    id, setup, packet, _ := syntheticSpectrumStream(2, [][2]int{{0, 1}}, []bool{true, true})
+    packets := [][]byte{id, syntheticCommentHeader("vendor"), setup, packet}
+    rng := rand.New(rand.NewSource(25))
+    for i := 0; i < 8; i++ {
+      garbage := make([]byte, 1+rng.Intn(32))
+      rng.Read(garbage)
+      packets = append(packets, garbage)
+    }
+    return packets
+  }, nil},
+}
+
+// readBadHeaders returns the packets of each stream in testdata/bad_headers,
+// in the same order as bad_header_streams.  The packets are read back from
+// the files so that the specs check what's checked in.
+func readBadHeaders() ([][][]byte, error) {
+  var streams [][][]byte
+  for _, stream := range bad_header_streams {
+    path := filepath.Join("testdata", "bad_headers", stream.name)
+    if *update_headers {
+      if err := ioutil.WriteFile(path, oggStream(stream.packets()...), 0644); err != nil {
+        return nil, err
+      }
+    }
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+      return nil, err
+    }
+    pr := ogg.NewPacketReader(bytes.NewReader(data))
+    var packets [][]byte
+    for {
+      packet, err := pr.ReadPacket()
+      if err == io.EOF {
+        break
+      }
+      if err != nil {
+        return nil, err
+      }
+      packets = append(packets, packet.Data)
+    }
+    streams = append(streams, packets)
+  }
+  return streams, nil
+}
+
+func BadHeaderSpec(c gospec.Context) {
+  streams, err := readBadHeaders()
+  c.Assume(err, Equals, nil)
+
+  c.Specify("Each stream of bad headers gives its error", func() {
+    for i, stream := range bad_header_streams {
+      d, err := vorbis.NewDecoder(bytes.NewReader(oggStream(streams[i]...)))
+      if stream.err != nil {
+        c.Expect(errors.Is(err, stream.err), IsTrue)
+        continue
+      }
+      c.Assume(err, Equals, nil)
+      buf := make([]float32, 1024)
+      for err == nil {
+        _, err = d.ReadFloat32(buf)
+      }
+      c.Expect(err, Equals, io.EOF)
+    }
+  })
+}
+
+// checkHeaderError fails unless err is nil or a *vorbis.HeaderError
+func checkHeaderError(t *testing.T, err error) {
+  var header_err *vorbis.HeaderError
+  if err != nil && !errors.As(err, &header_err) {
+    t.Fatalf("Unexpected error type: %v", err)
+  }
+}
+
+// addHeaderSeeds adds the packet at the given index of each stream in
+// testdata/bad_headers to the corpus of a fuzz target, 0 being the id header.
+func addHeaderSeeds(f *testing.F, index int) {
+  streams, err := readBadHeaders()
+  if err != nil {
+    f.Fatal(err)
+  }
+  for _, packets := range streams {
+    if index < len(packets) {
+      f.Add(packets[index])
+    }
+  }
+}
+
+func FuzzIdHeader(f *testing.F) {
+  f.Add(syntheticIdHeader(2, 44100, 256, 2048))
+  addHeaderSeeds(f, 0)
+  f.Fuzz(func(t *testing.T, data []byte) {
+    checkHeaderError(t, vorbis.ReadIdHeader(data))
+  })
+}
+
+func FuzzCommentHeader(f *testing.F) {
+  f.Add(syntheticCommentHeader("vendor", "TITLE=test", "ARTIST=someone"))
+  addHeaderSeeds(f, 1)
+  f.Fuzz(func(t *testing.T, data []byte) {
+    checkHeaderError(t, vorbis.ReadCommentHeader(data))
+  })
+}
+
+// FuzzSetupHeader reads fuzzed setup headers for a fixed stereo id header
+func FuzzSetupHeader(f *testing.F) {
+  id, setup, _, _ := syntheticSpectrumStream(2, [][2]int{{0, 1}}, []bool{true, true})
+  f.Add(setup)
+  addHeaderSeeds(f, 2)
+  f.Fuzz(func(t *testing.T, data []byte) {
+    checkHeaderError(t, vorbis.ReadSetupHeader(id, data))
+  })
+}
+
+// FuzzAudioPacket decodes a fuzzed audio packet twice after a valid one, so
+// that it's overlapped with both a valid block and itself.  Damaged audio
+// packets are never an error, they just decode to something.
+func FuzzAudioPacket(f *testing.F) {
+  id, setup, packet, _ := syntheticSpectrumStream(2, [][2]int{{0, 1}}, []bool{true, true})
+  f.Add(packet)
+  streams, err := readBadHeaders()
+  if err != nil {
+    f.Fatal(err)
+  }
+  for _, garbage := range streams[len(streams)-1][4:] {
+    f.Add(garbage)
+  }
+  f.Fuzz(func(t *testing.T, data []byte) {
+    if _, err := vorbis.DecodePackets(id, setup, packet, data, data); err != nil {
+      t.Fatalf("Audio packet gave an error: %v", err)
+    }
+  })
+}
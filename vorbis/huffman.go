@@ -0,0 +1,166 @@
+package vorbis
+
+// Codewords no longer than this are decoded with a single table lookup
+const huffman_table_bits = 10
+
+// A huffmanTable decodes codewords by looking at the next few bits of the
+// packet all at once.  Bits are read from the packet least significant bit
+// first while codewords are written most significant bit first, so the table
+// is indexed by bit reversed codewords.
+type huffmanTable struct {
+  bits int
+
+  // slots[peek] for every possible value of the next bits bits.  Codewords
+  // that are longer than bits share a slot with every other codeword that
+  // has the same prefix, those are listed in long_codes.
+  slots []huffmanSlot
+
+  long_codes []huffmanCode
+
+  // A codebook with a single used entry decodes that entry no matter what
+  // bits follow it.
+  single        bool
+  single_entry  int
+  single_length int
+}
+
+type huffmanSlot struct {
+  // The length of the codeword, 0 if no codeword starts with these bits, or
+  // -1 if the codeword is longer than the table.
+  length int32
+
+  // The entry number of the codeword, or for long codewords the position of
+  // the first candidate in long_codes.
+  entry int32
+
+  // The number of candidates in long_codes
+  count int32
+}
+
+type huffmanCode struct {
+  reversed uint32
+  length   int
+  entry    int
+}
+
+func reverseBits(word uint32, length int) uint32 {
+  var r uint32
+  for i := 0; i < length; i++ {
+    r = (r << 1) | (word & 1)
+    word >>= 1
+  }
+  return r
+}
+
+// buildHuffmanTable builds the decode table for a codebook, the codewords
+// must already have been assigned.
+func (book *Codebook) buildHuffmanTable() {
+  t := &book.table
+  max_length := 0
+  used := 0
+  for i, entry := range book.Entries {
+    if entry.Unused {
+      continue
+    }
+    used++
+    t.single_entry = i
+    t.single_length = entry.Length
+    if entry.Length > max_length {
+      max_length = entry.Length
+    }
+  }
+  t.single = used == 1
+
+  t.bits = max_length
+  if t.bits > huffman_table_bits {
+    t.bits = huffman_table_bits
+  }
+  t.slots = make([]huffmanSlot, 1<<uint(t.bits))
+  t.long_codes = nil
+
+  // Long codewords are grouped by their prefix so that each slot only has to
+  // search through the codewords that could possibly match.
+  var long_codes [][]huffmanCode
+  long_slots := make(map[uint32]int)
+  for i, entry := range book.Entries {
+    if entry.Unused || entry.Length == 0 {
+      continue
+    }
+    reversed := reverseBits(entry.Codeword, entry.Length)
+    if entry.Length <= t.bits {
+      for j := reversed; j < uint32(len(t.slots)); j += 1 << uint(entry.Length) {
+        t.slots[j] = huffmanSlot{length: int32(entry.Length), entry: int32(i)}
+      }
+      continue
+    }
+    prefix := reversed & (1<<uint(t.bits) - 1)
+    group, ok := long_slots[prefix]
+    if !ok {
+      group = len(long_codes)
+      long_slots[prefix] = group
+      long_codes = append(long_codes, nil)
+    }
+    long_codes[group] = append(long_codes[group], huffmanCode{reversed, entry.Length, i})
+  }
+  for prefix, group := range long_slots {
+    t.slots[prefix] = huffmanSlot{
+      length: -1,
+      entry:  int32(len(t.long_codes)),
+      count:  int32(len(long_codes[group])),
+    }
+    t.long_codes = append(t.long_codes, long_codes[group]...)
+  }
+}
+
+// decode reads a single codeword and returns its entry number, or -1 if the
+// packet ends first.  A codeword that isn't in the codebook is treated the
+// same as the end of the packet.
+func (t *huffmanTable) decode(br *BitReader) int {
+  if t.single {
+    // The codeword is still as long as it says it is, even though its value
+    // doesn't matter.
+    br.SkipBits(t.single_length)
+    if br.CheckError() != nil {
+      return -1
+    }
+    return t.single_entry
+  }
+
+  peek, available := br.PeekBits(t.bits)
+  slot := t.slots[peek]
+  if slot.length > 0 {
+    if int(slot.length) > available {
+      br.SkipBits(int(slot.length))
+      return -1
+    }
+    br.SkipBits(int(slot.length))
+    return int(slot.entry)
+  }
+  if slot.length == 0 {
+    if available < t.bits {
+      // The packet ended part way through a codeword
+      br.SkipBits(t.bits)
+      return -1
+    }
+    br.err = errInvalidCodeword
+    return -1
+  }
+
+  peek, available = br.PeekBits(32)
+  for _, code := range t.long_codes[slot.entry : slot.entry+slot.count] {
+    if peek&(1<<uint(code.length)-1) != code.reversed {
+      continue
+    }
+    br.SkipBits(code.length)
+    if code.length > available {
+      return -1
+    }
+    return code.entry
+  }
+  if available < 32 {
+    br.SkipBits(32)
+    return -1
+  }
+  br.err = errInvalidCodeword
+  return -1
+}
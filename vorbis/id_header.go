@@ -3,7 +3,7 @@ package vorbis
 import (
   "encoding/binary"
   "bytes"
-  "fmt"
+  "ogg"
 )
 
 type idHeaderFixed struct {
@@ -21,62 +21,64 @@ type idHeader struct {
   Blocksize_1 int
 }
 
-func (header *idHeader) read(buffer *bytes.Buffer) {
+func (header *idHeader) read(buffer *bytes.Buffer, limits ogg.Limits) error {
   b, _ := buffer.ReadByte()
   if b != 1 {
-    panic(fmt.Sprintf("Header type == %d, expected type == 1.", b))
+    return idError("packet type", ErrNotVorbis)
   }
 
   if string(buffer.Next(6)) != "vorbis" {
-    panic("vorbis string not found in id header")
+    return idError("vorbis string", ErrNotVorbis)
   }
 
-  binary.Read(buffer, binary.LittleEndian, &header.idHeaderFixed)
-  var block_sizes uint8
-  binary.Read(buffer, binary.LittleEndian, &block_sizes)
+  if err := binary.Read(buffer, binary.LittleEndian, &header.idHeaderFixed); err != nil {
+    return idError("fields", ErrTruncatedHeader)
+  }
+  block_sizes, err := buffer.ReadByte()
+  if err != nil {
+    return idError("blocksizes", ErrTruncatedHeader)
+  }
   header.Blocksize_0 = int(1 << (block_sizes & 0x0f))
   header.Blocksize_1 = int(1 << ((block_sizes & 0xf0) >> 4))
 
-  var framing uint8
-  binary.Read(buffer, binary.LittleEndian, &framing)
-  if framing != 1 {
-    panic("Id header not properly framed")
+  framing, err := buffer.ReadByte()
+  if err != nil {
+    return idError("framing bit", ErrTruncatedHeader)
+  }
+  if framing&1 == 0 {
+    return idError("framing bit", ErrFraming)
   }
 
   if header.Version != 0 {
-    panic(fmt.Sprintf("Unexpected version number in id header: %d", header.Version))
+    return idError("version", ErrVersion)
   }
   if header.Channels == 0 {
-    panic("Channels set to zero in id header")
+    return idError("channels", ErrInvalidValue)
+  }
+  if int(header.Channels) > limits.Max_channels {
+    return idError("channels", &ogg.LimitError{Limit: "Max_channels", Value: int64(header.Channels), Max: int64(limits.Max_channels)})
   }
   if header.Sample_rate == 0 {
-    panic("Sample rate set to zero in id header")
+    return idError("sample rate", ErrInvalidValue)
   }
-  if header.Blocksize_0 != 64 &&
-    header.Blocksize_0 != 128 &&
-    header.Blocksize_0 != 256 &&
-    header.Blocksize_0 != 512 &&
-    header.Blocksize_0 != 1024 &&
-    header.Blocksize_0 != 2048 &&
-    header.Blocksize_0 != 4096 &&
-    header.Blocksize_0 != 8192 {
-    panic(fmt.Sprintf("Invalid block 0 size: %d", header.Blocksize_0))
+  if !validBlocksize(header.Blocksize_0) {
+    return idError("blocksize 0", ErrBlocksize)
   }
-  if header.Blocksize_1 != 64 &&
-    header.Blocksize_1 != 128 &&
-    header.Blocksize_1 != 256 &&
-    header.Blocksize_1 != 512 &&
-    header.Blocksize_1 != 1024 &&
-    header.Blocksize_1 != 2048 &&
-    header.Blocksize_1 != 4096 &&
-    header.Blocksize_1 != 8192 {
-    panic(fmt.Sprintf("Invalid block 1 size: %d", header.Blocksize_1))
+  if !validBlocksize(header.Blocksize_1) {
+    return idError("blocksize 1", ErrBlocksize)
   }
   if header.Blocksize_0 > header.Blocksize_1 {
-    panic(fmt.Sprintf("Block 0 size > block 1 size: %d > %d", header.Blocksize_0, header.Blocksize_1))
+    return idError("blocksize 0 larger than blocksize 1", ErrBlocksize)
   }
 
   if buffer.Len() > 0 {
     // TODO: Shouldn't be anything leftover, log a warning?
   }
+  return nil
+}
+
+// validBlocksize returns true for the block sizes allowed by the spec, the
+// powers of two from 64 to 8192.
+func validBlocksize(n int) bool {
+  return n >= 64 && n <= 8192
 }
@@ -0,0 +1,110 @@
+package vorbis
+
+import "math"
+
+// An imdct holds the precomputed tables for an inverse MDCT of a single
+// blocksize.  The n point inverse MDCT is computed as an n/2 point DCT-IV,
+// which is in turn computed with an n/4 point complex FFT, so every legal
+// blocksize from 64 to 8192 works without any cgo.
+type imdct struct {
+  n int
+
+  // exp(-2*pi*i*(k+1/8)/n) for 0 <= k < n/4, applied before and after the FFT
+  twiddle []complex128
+
+  // exp(-2*pi*i*k/(n/4)) for 0 <= k < n/8, used by the FFT butterflies
+  fft_twiddle []complex128
+
+  bit_reverse []int
+
+  // Scratch space so that transforms don't allocate
+  fft_buffer []complex128
+  dct_buffer []float64
+}
+
+func makeIMDCT(n int) *imdct {
+  var m imdct
+  m.n = n
+  n2 := n / 2
+  n4 := n / 4
+
+  m.twiddle = make([]complex128, n4)
+  for k := range m.twiddle {
+    theta := -2 * math.Pi * (float64(k) + 0.125) / float64(n)
+    m.twiddle[k] = complex(math.Cos(theta), math.Sin(theta))
+  }
+
+  m.fft_twiddle = make([]complex128, n4/2)
+  for k := range m.fft_twiddle {
+    theta := -2 * math.Pi * float64(k) / float64(n4)
+    m.fft_twiddle[k] = complex(math.Cos(theta), math.Sin(theta))
+  }
+
+  bits := ilog(uint32(n4)) - 1
+  m.bit_reverse = make([]int, n4)
+  for k := range m.bit_reverse {
+    r := 0
+    for b := 0; b < bits; b++ {
+      if k&(1<<uint(b)) != 0 {
+        r |= 1 << uint(bits-1-b)
+      }
+    }
+    m.bit_reverse[k] = r
+  }
+
+  m.fft_buffer = make([]complex128, n4)
+  m.dct_buffer = make([]float64, n2)
+  return &m
+}
+
+// inverse computes the inverse MDCT of the n/2 coefficients in in and
+// writes the n resulting samples to out.  The result is the unscaled
+// transform from the spec, out[j] = sum over k of
+// in[k] * cos(2*pi/n * (j + 1/2 + n/4) * (k + 1/2)).
+func (m *imdct) inverse(in, out []float64) {
+  n2 := m.n / 2
+  n4 := m.n / 4
+  buf := m.fft_buffer
+
+  // Fold the even and reversed odd coefficients into n/4 complex values and
+  // apply the pre-twiddle, storing them in bit reversed order for the FFT.
+  for k := 0; k < n4; k++ {
+    z := complex(in[2*k], in[n2-1-2*k])
+    buf[m.bit_reverse[k]] = z * m.twiddle[k]
+  }
+
+  // Iterative radix-2 FFT
+  for size := 2; size <= n4; size *= 2 {
+    half := size / 2
+    step := n4 / size
+    for start := 0; start < n4; start += size {
+      for j := 0; j < half; j++ {
+        a := buf[start+j]
+        b := buf[start+j+half] * m.fft_twiddle[j*step]
+        buf[start+j] = a + b
+        buf[start+j+half] = a - b
+      }
+    }
+  }
+
+  // Post-twiddle gives the DCT-IV of the input
+  dct := m.dct_buffer
+  for k := 0; k < n4; k++ {
+    w := buf[k] * m.twiddle[k]
+    dct[2*k] = real(w)
+    dct[n2-1-2*k] = -imag(w)
+  }
+
+  // The inverse MDCT is the DCT-IV shifted by n/4 and extended using its
+  // symmetries: even around -1/2 and odd around n/2 - 1/2.
+  n34 := n2 + n4
+  for j := 0; j < n4; j++ {
+    out[j] = dct[j+n4]
+  }
+  for j := n4; j < n34; j++ {
+    out[j] = -dct[n34-1-j]
+  }
+  for j := n34; j < m.n; j++ {
+    out[j] = -dct[j-n34]
+  }
+}
@@ -0,0 +1,133 @@
+package vorbis
+
+import (
+  "io"
+  "ogg"
+)
+
+// Length describes how long a stream is.  Samples is per channel, and Bitrate
+// is the average number of bits per second over the whole input, including
+// the headers and the Ogg framing.
+type Length struct {
+  Samples int64
+  Seconds float64
+  Bitrate float64
+}
+
+// ReadLength works out the length of the first Vorbis stream in in without
+// decoding any audio.  Only the headers and the first audio page are read
+// from the start of the stream.  If in is an io.ReadSeeker the end of the
+// stream is found by scanning backwards from the end of the file, otherwise
+// the rest of the input is read through.
+func ReadLength(in io.Reader) (Length, error) {
+  var start int64
+  rs, seekable := in.(io.ReadSeeker)
+  if seekable {
+    var err error
+    if start, err = rs.Seek(0, 1); err != nil {
+      return Length{}, err
+    }
+  }
+
+  var v vorbisDecoder
+  packets := ogg.NewPacketReaderChoosing(in, ogg.Options{}, isVorbis)
+  for v.mode != readData {
+    packet, err := packets.ReadPacket()
+    if err == io.EOF && v.mode == readId {
+      return Length{}, idError("bitstream", ErrNotVorbis)
+    }
+    if err == io.EOF {
+      err = io.ErrUnexpectedEOF
+    }
+    if err != nil {
+      return Length{}, err
+    }
+    if _, err := v.readPacket(packet.Data); err != nil {
+      return Length{}, err
+    }
+  }
+
+  // The first granule position is the position of the last sample finished
+  // by its packet, so counting the samples finished up to there gives the
+  // position of the first sample.  That's normally 0, but a stream that was
+  // cut out of a longer one can start later.
+  begin, end, err := firstGranule(&v, packets)
+  if err != nil {
+    return Length{}, err
+  }
+
+  var size int64
+  if seekable {
+    granule, err := ogg.LastGranule(rs, packets.Serial())
+    if err != nil && err != io.EOF {
+      return Length{}, err
+    }
+    if err == nil {
+      end = int64(granule)
+    }
+    if size, err = rs.Seek(0, 2); err != nil {
+      return Length{}, err
+    }
+    size -= start
+  } else {
+    for {
+      packet, err := packets.ReadPacket()
+      if err == io.EOF {
+        break
+      }
+      if err != nil {
+        return Length{}, err
+      }
+      if packet.Granule_position != ogg.NoGranulePosition {
+        end = int64(packet.Granule_position)
+      }
+    }
+    size = packets.BytesRead()
+  }
+
+  // If the first page says fewer samples were finished than its packets
+  // hold, the extra ones at the start are meant to be thrown away.
+  if begin < 0 {
+    begin = 0
+  }
+  var length Length
+  if end > begin {
+    length.Samples = end - begin
+  }
+  if v.Sample_rate > 0 {
+    length.Seconds = float64(length.Samples) / float64(v.Sample_rate)
+  }
+  if length.Seconds > 0 {
+    length.Bitrate = float64(size) * 8 / length.Seconds
+  }
+  return length, nil
+}
+
+// firstGranule reads audio packets up to the first one with a granule
+// position and returns the position of the first sample of the stream and
+// that granule position.
+func firstGranule(v *vorbisDecoder, packets *ogg.PacketReader) (begin, end int64, err error) {
+  // The first audio packet only primes the overlap, after that each packet
+  // finishes a quarter of the previous block and a quarter of its own.
+  samples := int64(0)
+  previous := 0
+  for {
+    packet, err := packets.ReadPacket()
+    if err == io.EOF {
+      return 0, 0, nil
+    }
+    if err != nil {
+      return 0, 0, err
+    }
+    if current := v.blocksize(packet.Data); current != 0 {
+      if previous != 0 {
+        samples += int64(previous/4 + current/4)
+      }
+      previous = current
+    }
+    if packet.Granule_position != ogg.NoGranulePosition {
+      end = int64(packet.Granule_position)
+      return end - samples, end, nil
+    }
+  }
+}
@@ -16,12 +16,12 @@ type submap struct {
   residue int
 }
 
-func readMapping(br *BitReader, num_channels, num_floors, num_residues int) Mapping {
+func readMapping(br *BitReader, num_channels, num_floors, num_residues int) (Mapping, error) {
+  var mapping Mapping
   mapping_type := int(br.ReadBits(16))
   if mapping_type != 0 {
-    panic("Found a non-zero mapping type.")
+    return mapping, setupError("mapping type", ErrReserved)
   }
-  var mapping Mapping
 
   flag := br.ReadBits(1) != 0
   submaps := 1
@@ -36,18 +36,18 @@ func readMapping(br *BitReader, num_channels, num_floors, num_residues int) Mapp
       mapping.couplings[i].magnitude = int(br.ReadBits(bits))
       mapping.couplings[i].angle = int(br.ReadBits(bits))
       if mapping.couplings[i].magnitude == mapping.couplings[i].angle {
-        panic("Mapping angle channel and mapping magnitude channel cannot be equal.")
+        return mapping, setupError("coupling channels are the same", ErrInvalidValue)
       }
       if mapping.couplings[i].magnitude >= num_channels {
-        panic("Mapping magnitude channel is out of range.")
+        return mapping, setupError("coupling magnitude channel", ErrOutOfRange)
       }
       if mapping.couplings[i].angle >= num_channels {
-        panic("Mapping angle channel is out of range.")
+        return mapping, setupError("coupling angle channel", ErrOutOfRange)
       }
     }
   }
   if br.ReadBits(2) != 0 {
-    panic("Non-zero reserved bits found when reading mappings.")
+    return mapping, setupError("reserved bits", ErrReserved)
   }
 
   mapping.muxs = make([]int, num_channels)
@@ -55,7 +55,7 @@ func readMapping(br *BitReader, num_channels, num_floors, num_residues int) Mapp
     for i := range mapping.muxs {
       mapping.muxs[i] = int(br.ReadBits(4))
       if mapping.muxs[i] >= submaps {
-        panic("Mapping mux is out of range.")
+        return mapping, setupError("mux", ErrOutOfRange)
       }
     }
   }
@@ -65,13 +65,16 @@ func readMapping(br *BitReader, num_channels, num_floors, num_residues int) Mapp
     br.ReadBits(8) // explicitly discarded
     mapping.submaps[i].floor = int(br.ReadBits(8))
     if mapping.submaps[i].floor >= num_floors {
-      panic("Mapping submap floor is out of range.")
+      return mapping, setupError("submap floor", ErrOutOfRange)
     }
     mapping.submaps[i].residue = int(br.ReadBits(8))
     if mapping.submaps[i].residue >= num_residues {
-      panic("Mapping submap residue is out of range.")
+      return mapping, setupError("submap residue", ErrOutOfRange)
     }
   }
+  if br.CheckError() != nil {
+    return mapping, setupError("submaps", ErrTruncatedHeader)
+  }
 
-  return mapping
+  return mapping, nil
 }
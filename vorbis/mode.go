@@ -5,7 +5,7 @@ type Mode struct {
   mapping    int
 }
 
-func readMode(br *BitReader, num_mappings int) Mode {
+func readMode(br *BitReader, num_mappings int) (Mode, error) {
   var m Mode
 
   m.block_flag = br.ReadBits(1) == 1
@@ -13,19 +13,22 @@ func readMode(br *BitReader, num_mappings int) Mode {
   // Don't bother storing this, we know it has to be zero
   window_type := int(br.ReadBits(16))
   if window_type != 0 {
-    panic("Found non-zero window type while reading modes.")
+    return m, setupError("window type", ErrReserved)
   }
 
   // Don't bother storing this, we know it has to be zero
   transform_type := int(br.ReadBits(16))
   if transform_type != 0 {
-    panic("Found non-zero transform type while reading modes.")
+    return m, setupError("transform type", ErrReserved)
   }
 
   m.mapping = int(br.ReadBits(8))
+  if br.CheckError() != nil {
+    return m, setupError("mapping", ErrTruncatedHeader)
+  }
   if m.mapping >= num_mappings {
-    panic("Mode mapping value is out of range.")
+    return m, setupError("mapping", ErrOutOfRange)
   }
 
-  return m
+  return m, nil
 }
@@ -28,7 +28,6 @@ type residue1 struct {
 }
 
 func (r *residue1) Decode(br *BitReader, books []Codebook, ch int, do_not_decode []bool, n int) [][]float64 {
-  print("starting format 1\n")
   return r.residueBase.decode(br, books, ch, do_not_decode, n, 1)
 }
 
@@ -52,15 +51,15 @@ func (r *residue2) Decode(br *BitReader, books []Codebook, ch int, do_not_decode
     data = r.decode(br, books, 1, []bool{false}, ch*n, 1)[0]
   }
 
-  // TODO: spec says to do this step even if we are using a blank array
-  //       that just seems dumb
+  // The channels are interleaved in the decoded vector, so element i of
+  // channel j is at i*ch+j.
   output := make([][]float64, ch)
   for i := range output {
     output[i] = make([]float64, n)
   }
   for i := 0; i < n; i++ {
     for j := 0; j < ch; j++ {
-      output[j][i] = data[i+ch*j]
+      output[j][i] = data[i*ch+j]
     }
   }
 
@@ -94,7 +93,7 @@ func (r *residueBase) decode(br *BitReader, books []Codebook, ch int, do_not_dec
 
   classifications := make([][]int, ch)
   for i := range classifications {
-    classifications[i] = make([]int, partitions_to_read + classwords_per_codeword)
+    classifications[i] = make([]int, partitions_to_read+classwords_per_codeword)
   }
 
   for pass := 0; pass < 8; pass++ {
@@ -106,6 +105,10 @@ func (r *residueBase) decode(br *BitReader, books []Codebook, ch int, do_not_dec
             continue
           }
           temp := book.DecodeScalar(br)
+          if temp < 0 {
+            // The packet ended early, everything decoded so far is kept
+            return residue_vecs
+          }
           for i := classwords_per_codeword - 1; i >= 0; i-- {
             classifications[j][i+partition_count] = temp % r.num_classifications
             temp /= r.num_classifications
@@ -113,49 +116,20 @@ func (r *residueBase) decode(br *BitReader, books []Codebook, ch int, do_not_dec
         }
       }
       for i := 0; i < classwords_per_codeword && partition_count < partitions_to_read; i++ {
+        offset := limit_begin + partition_count*r.partition_size
         for j := 0; j < ch; j++ {
           if do_not_decode[j] {
-            partition_count++
             continue
           }
-          vq_class := classifications[j][partition_count]
-          vq_book := r.books[vq_class][pass]
+          vq_book := r.books[classifications[j][partition_count]][pass]
           if vq_book == -1 {
-            partition_count++
             continue
           }
-          book := books[vq_book]
-
-          n := r.partition_size
-          v := residue_vecs[j]
-          offset := limit_begin + partition_count*r.partition_size
-
-          if mode == 0 {
-            // format 0
-            print("format 0\n")
-            step := n / book.Dimensions
-            for i := 0; i < step; i++ {
-              temp := book.DecodeVector(br)
-              for j := 0; j < book.Dimensions; j++ {
-                v[offset+i+j*step] += temp[j]
-                print("temp: ", temp[j])
-              }
-            }
-          } else {
-            // format 1 (used by format 2)
-            print("format 1\n")
-            i := 0
-            for i < n {
-              temp := book.DecodeVector(br)
-              for j := 0; j < book.Dimensions; j++ {
-                v[offset+i] += temp[j]
-                print("temp: ", temp[j])
-                i++
-              }
-            }
+          if !r.decodePartition(br, &books[vq_book], residue_vecs[j][offset:offset+r.partition_size], mode) {
+            return residue_vecs
           }
-          partition_count++
         }
+        partition_count++
       }
     }
   }
@@ -163,15 +137,49 @@ func (r *residueBase) decode(br *BitReader, books []Codebook, ch int, do_not_dec
   return residue_vecs
 }
 
-func readResidue(br *BitReader) Residue {
+// decodePartition adds a single partition of residue to v, which is exactly
+// one partition long.  In format 0 the vectors are interleaved across the
+// partition, in format 1 they are laid out one after another.  It returns
+// false if the packet ended before the partition was complete.
+func (r *residueBase) decodePartition(br *BitReader, book *Codebook, v []float64, mode int) bool {
+  if mode == 0 {
+    step := len(v) / book.Dimensions
+    for i := 0; i < step; i++ {
+      temp := book.DecodeVector(br)
+      if temp == nil {
+        return false
+      }
+      for j := range temp {
+        v[i+j*step] += temp[j]
+      }
+    }
+    return true
+  }
+
+  for i := 0; i < len(v); {
+    temp := book.DecodeVector(br)
+    if temp == nil {
+      return false
+    }
+    for j := 0; j < len(temp) && i < len(v); j++ {
+      v[i] += temp[j]
+      i++
+    }
+  }
+  return true
+}
+
+func readResidue(br *BitReader, codebooks []Codebook) (Residue, error) {
   var residue Residue
 
   var base residueBase
   residue_type := int(br.ReadBits(16))
   if residue_type < 0 || residue_type > 2 {
-    panic("Unknown residue type.")
+    return nil, setupError("residue type", ErrReserved)
+  }
+  if err := base.read(br, codebooks); err != nil {
+    return nil, err
   }
-  base.read(br)
   switch residue_type {
   case 0:
     residue = &residue0{base}
@@ -181,17 +189,27 @@ func readResidue(br *BitReader) Residue {
     residue = &residue2{base}
   }
 
-  return residue
+  return residue, nil
 }
 
-func (r *residueBase) read(br *BitReader) {
+func (r *residueBase) read(br *BitReader, codebooks []Codebook) error {
   r.begin = int(br.ReadBits(24))
   r.end = int(br.ReadBits(24))
+  if r.end < r.begin {
+    return setupError("end before begin", ErrInvalidValue)
+  }
   r.partition_size = int(br.ReadBits(24) + 1)
   r.num_classifications = int(br.ReadBits(6) + 1)
   r.classbook = int(br.ReadBits(8))
+  if r.classbook >= len(codebooks) {
+    return setupError("classbook", ErrOutOfRange)
+  }
+  // Each classbook codeword holds Dimensions classifications, so a book
+  // without any would never get through the partitions.
+  if codebooks[r.classbook].Dimensions == 0 {
+    return setupError("classbook dimensions", ErrInvalidValue)
+  }
 
-  // TODO: There are some checks that can go here
   cascades := make([]uint32, r.num_classifications)
   for i := range cascades {
     high_bits := 0
@@ -209,9 +227,20 @@ func (r *residueBase) read(br *BitReader) {
     for j := 0; j < 8; j++ {
       if (cascades[i] & (uint32(1) << uint32(j))) != 0 {
         r.books[i][j] = int(br.ReadBits(8))
+        if r.books[i][j] >= len(codebooks) {
+          return setupError("book", ErrOutOfRange)
+        }
+        // Residue is decoded as vectors, so the book has to have them
+        if codebooks[r.books[i][j]].Value_vectors == nil {
+          return setupError("book without value vectors", ErrInvalidValue)
+        }
       } else {
         r.books[i][j] = -1
       }
     }
   }
+  if br.CheckError() != nil {
+    return setupError("books", ErrTruncatedHeader)
+  }
+  return nil
 }
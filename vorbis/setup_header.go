@@ -3,6 +3,7 @@ package vorbis
 import (
   "bytes"
   "fmt"
+  "ogg"
 )
 
 type setupHeader struct {
@@ -14,23 +15,45 @@ type setupHeader struct {
   Mode_configs    []Mode
 }
 
-func (header *setupHeader) read(buffer *bytes.Buffer, num_channels int) {
+// A setupBudget keeps count of the memory that the tables built from a setup
+// header need, so that it can be checked before they are allocated.
+type setupBudget struct {
+  limits ogg.Limits
+  used   int64
+}
+
+// take adds n bytes for field to the memory used so far, and returns an
+// error if that goes over Max_setup_memory.
+func (b *setupBudget) take(field string, n int64) error {
+  b.used += n
+  if b.used > int64(b.limits.Max_setup_memory) {
+    return setupError(field, &ogg.LimitError{Limit: "Max_setup_memory", Value: b.used, Max: int64(b.limits.Max_setup_memory)})
+  }
+  return nil
+}
+
+func (header *setupHeader) read(buffer *bytes.Buffer, num_channels int, limits ogg.Limits) error {
   b, _ := buffer.ReadByte()
   if b != 5 {
-    panic(fmt.Sprintf("Header type == %d, expected type == 5.", b))
+    return setupError("packet type", ErrNotVorbis)
   }
 
   if string(buffer.Next(6)) != "vorbis" {
-    panic("vorbis string not found in setup header")
+    return setupError("vorbis string", ErrNotVorbis)
   }
 
   // Decode Codebooks
-  codebook_count, _ := buffer.ReadByte()
-  codebook_count++
-  header.Codebooks = make([]Codebook, int(codebook_count))
-  br := MakeBitReader(buffer)
+  codebook_count, err := buffer.ReadByte()
+  if err != nil {
+    return setupError("codebook count", ErrTruncatedHeader)
+  }
+  header.Codebooks = make([]Codebook, int(codebook_count)+1)
+  br := MakeBitReader(buffer.Bytes())
+  budget := &setupBudget{limits: limits}
   for i := range header.Codebooks {
-    header.Codebooks[i].decode(br)
+    if err := header.Codebooks[i].decode(br, budget); err != nil {
+      return within(fmt.Sprintf("codebook %d", i), err)
+    }
   }
 
   // Read Time Domain Transfers
@@ -39,39 +62,56 @@ func (header *setupHeader) read(buffer *bytes.Buffer, num_channels int) {
   time_transfers_count := int(br.ReadBits(6) + 1)
   for i := 0; i < time_transfers_count; i++ {
     if br.ReadBits(16) != 0 {
-      panic("Time Domain Transfer Value != 0")
+      return setupError("time domain transform", ErrReserved)
     }
   }
 
   floor_count := int(br.ReadBits(6) + 1)
   header.Floor_configs = make([]Floor, floor_count)
   for i := range header.Floor_configs {
-    header.Floor_configs[i] = readFloor(br, len(header.Codebooks))
+    header.Floor_configs[i], err = readFloor(br, header.Codebooks)
+    if err != nil {
+      return within(fmt.Sprintf("floor %d", i), err)
+    }
   }
 
   // Read Resiudes
   residue_count := int(br.ReadBits(6) + 1)
   header.Residue_configs = make([]Residue, residue_count)
   for i := range header.Residue_configs {
-    header.Residue_configs[i] = readResidue(br)
+    header.Residue_configs[i], err = readResidue(br, header.Codebooks)
+    if err != nil {
+      return within(fmt.Sprintf("residue %d", i), err)
+    }
   }
 
   // Read Mappings
   mapping_count := int(br.ReadBits(6) + 1)
   header.Mapping_configs = make([]Mapping, mapping_count)
   for i := range header.Mapping_configs {
-    header.Mapping_configs[i] = readMapping(br, num_channels, floor_count, residue_count)
+    header.Mapping_configs[i], err = readMapping(br, num_channels, floor_count, residue_count)
+    if err != nil {
+      return within(fmt.Sprintf("mapping %d", i), err)
+    }
   }
 
   // Read Modes
   mode_count := int(br.ReadBits(6) + 1)
   header.Mode_configs = make([]Mode, mode_count)
   for i := range header.Mode_configs {
-    header.Mode_configs[i] = readMode(br, len(header.Mapping_configs))
+    header.Mode_configs[i], err = readMode(br, len(header.Mapping_configs))
+    if err != nil {
+      return within(fmt.Sprintf("mode %d", i), err)
+    }
   }
 
   // Frame
-  if br.ReadBits(1) == 0 {
-    panic("Framing error in setup header.")
+  framing := br.ReadBits(1)
+  if br.CheckError() != nil {
+    return setupError("framing bit", ErrTruncatedHeader)
+  }
+  if framing == 0 {
+    return setupError("framing bit", ErrFraming)
   }
+  return nil
 }
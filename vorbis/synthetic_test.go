@@ -0,0 +1,432 @@
+package vorbis_test
+
+import (
+  "encoding/binary"
+  "math"
+)
+
+// The helpers in this file build synthetic vorbis streams so that parts of
+// the decoder that aren't exercised by any real file can still be tested.
+
+// bitWriter packs values the same way the vorbis bitstream does, starting
+// from the least significant bit of each byte.
+type bitWriter struct {
+  data []byte
+  bits int
+}
+
+func (w *bitWriter) Write(value uint32, n int) {
+  for i := 0; i < n; i++ {
+    if w.bits%8 == 0 {
+      w.data = append(w.data, 0)
+    }
+    if value&(1<<uint(i)) != 0 {
+      w.data[len(w.data)-1] |= 1 << uint(w.bits%8)
+    }
+    w.bits++
+  }
+}
+
+func (w *bitWriter) WriteBool(b bool) {
+  if b {
+    w.Write(1, 1)
+  } else {
+    w.Write(0, 1)
+  }
+}
+
+// WriteCodeword writes a huffman codeword, which is packed starting from its
+// most significant bit.
+func (w *bitWriter) WriteCodeword(word uint32, length int) {
+  for i := length - 1; i >= 0; i-- {
+    w.Write(word>>uint(i), 1)
+  }
+}
+
+func (w *bitWriter) Bytes() []byte {
+  return w.data
+}
+
+// float32Pack is the inverse of the packed float format used by codebooks.
+func float32Pack(v float64) uint32 {
+  if v == 0 {
+    return 0
+  }
+  var sign uint32
+  if v < 0 {
+    sign = 0x80000000
+    v = -v
+  }
+  frac, exp := math.Frexp(v)
+  mantissa := uint32(frac * (1 << 21))
+  return sign | uint32(exp-21+788)<<21 | mantissa
+}
+
+func syntheticIdHeader(channels, rate, blocksize_0, blocksize_1 int) []byte {
+  data := []byte("\x01vorbis")
+  fixed := struct {
+    Version         uint32
+    Channels        uint8
+    Sample_rate     uint32
+    Bitrate_maximum uint32
+    Bitrate_nominal uint32
+    Bitrate_minimum uint32
+    Block_sizes     uint8
+    Framing         uint8
+  }{0, uint8(channels), uint32(rate), 0, 0, 0, 0, 1}
+  var w bitWriter
+  w.Write(uint32(ilog(blocksize_0)-1), 4)
+  w.Write(uint32(ilog(blocksize_1)-1), 4)
+  fixed.Block_sizes = w.Bytes()[0]
+  var buf sliceWriter
+  binary.Write(&buf, binary.LittleEndian, &fixed)
+  return append(data, buf...)
+}
+
+func syntheticCommentHeader(vendor string, comments ...string) []byte {
+  var buf sliceWriter
+  buf = append(buf, "\x03vorbis"...)
+  binary.Write(&buf, binary.LittleEndian, uint32(len(vendor)))
+  buf = append(buf, vendor...)
+  binary.Write(&buf, binary.LittleEndian, uint32(len(comments)))
+  for _, comment := range comments {
+    binary.Write(&buf, binary.LittleEndian, uint32(len(comment)))
+    buf = append(buf, comment...)
+  }
+  return append(buf, 1)
+}
+
+type sliceWriter []byte
+
+func (s *sliceWriter) Write(p []byte) (int, error) {
+  *s = append(*s, p...)
+  return len(p), nil
+}
+
+func ilog(n int) int {
+  r := 0
+  for n > 0 {
+    r++
+    n >>= 1
+  }
+  return r
+}
+
+type syntheticCodebook struct {
+  dimensions    int
+  lengths       []int
+  lookup_type   int
+  minimum       float64
+  delta         float64
+  value_bits    int
+  sequence_p    bool
+  multiplicands []uint32
+
+  // An ordered codebook must have lengths that never decrease.  A sparse
+  // codebook marks unused entries with a length of 0.
+  ordered bool
+  sparse  bool
+}
+
+func (book *syntheticCodebook) write(w *bitWriter) {
+  w.Write(0x564342, 24)
+  w.Write(uint32(book.dimensions), 16)
+  w.Write(uint32(len(book.lengths)), 24)
+  w.WriteBool(book.ordered)
+  switch {
+  case book.ordered:
+    length := book.lengths[0]
+    w.Write(uint32(length-1), 5)
+    for current := 0; current < len(book.lengths); length++ {
+      number := 0
+      for current+number < len(book.lengths) && book.lengths[current+number] == length {
+        number++
+      }
+      w.Write(uint32(number), ilog(len(book.lengths)-current))
+      current += number
+    }
+
+  case book.sparse:
+    w.WriteBool(true)
+    for _, length := range book.lengths {
+      w.WriteBool(length > 0)
+      if length > 0 {
+        w.Write(uint32(length-1), 5)
+      }
+    }
+
+  default:
+    w.WriteBool(false)
+    for _, length := range book.lengths {
+      w.Write(uint32(length-1), 5)
+    }
+  }
+  w.Write(uint32(book.lookup_type), 4)
+  if book.lookup_type > 0 {
+    w.Write(float32Pack(book.minimum), 32)
+    w.Write(float32Pack(book.delta), 32)
+    w.Write(uint32(book.value_bits-1), 4)
+    w.WriteBool(book.sequence_p)
+    for _, m := range book.multiplicands {
+      w.Write(m, book.value_bits)
+    }
+  }
+}
+
+type syntheticMode struct {
+  block_flag bool
+  mapping    int
+}
+
+// syntheticSetup builds a setup header.  Floors, residues and mappings are
+// written by arbitrary functions so that tests can write whatever they want,
+// including invalid configurations.
+type syntheticSetup struct {
+  codebooks []syntheticCodebook
+  floors    []func(w *bitWriter)
+  residues  []func(w *bitWriter)
+  mappings  []func(w *bitWriter)
+  modes     []syntheticMode
+}
+
+func (s *syntheticSetup) Bytes() []byte {
+  var w bitWriter
+  for _, c := range "\x05vorbis" {
+    w.Write(uint32(c), 8)
+  }
+  w.Write(uint32(len(s.codebooks)-1), 8)
+  for i := range s.codebooks {
+    s.codebooks[i].write(&w)
+  }
+  w.Write(0, 6)  // one time domain transform
+  w.Write(0, 16) // which must be zero
+  w.Write(uint32(len(s.floors)-1), 6)
+  for _, floor := range s.floors {
+    floor(&w)
+  }
+  w.Write(uint32(len(s.residues)-1), 6)
+  for _, residue := range s.residues {
+    residue(&w)
+  }
+  w.Write(uint32(len(s.mappings)-1), 6)
+  for _, mapping := range s.mappings {
+    mapping(&w)
+  }
+  w.Write(uint32(len(s.modes)-1), 6)
+  for _, mode := range s.modes {
+    w.WriteBool(mode.block_flag)
+    w.Write(0, 16)
+    w.Write(0, 16)
+    w.Write(uint32(mode.mapping), 8)
+  }
+  w.WriteBool(true) // framing
+  return w.Bytes()
+}
+
+// simpleSetup returns the smallest useful setup, with a flat floor, a
+// residue that decodes nothing and a single mapping and mode using them.
+func simpleSetup() syntheticSetup {
+  return syntheticSetup{
+    codebooks: []syntheticCodebook{
+      {dimensions: 1, lengths: []int{1, 1}},
+      {dimensions: 1, lengths: []int{1, 1}, lookup_type: 1, delta: 1, value_bits: 1, multiplicands: []uint32{0, 1}},
+    },
+    floors:   []func(w *bitWriter){writeFlatFloor1(5)},
+    residues: []func(w *bitWriter){writeEmptyResidue},
+    mappings: []func(w *bitWriter){writeSimpleMapping},
+    modes:    []syntheticMode{{false, 0}},
+  }
+}
+
+// hugeCodebookSetup returns the start of a setup header with an ordered
+// codebook saying that all 2^24-1 entries are 24 bits long, which only takes
+// a few bytes.
+func hugeCodebookSetup() []byte {
+  var w bitWriter
+  for _, c := range "\x05vorbis" {
+    w.Write(uint32(c), 8)
+  }
+  w.Write(0, 8)
+  w.Write(0x564342, 24)
+  w.Write(1, 16)
+  w.Write(0xffffff, 24)
+  w.WriteBool(true)
+  w.Write(23, 5)
+  w.Write(0xffffff, 24)
+  w.Write(0, 4)
+  return w.Bytes()
+}
+
+// writeEmptyResidue writes a type 0 residue that never decodes anything
+func writeEmptyResidue(w *bitWriter) {
+  w.Write(0, 16) // type
+  w.Write(0, 24) // begin
+  w.Write(0, 24) // end
+  w.Write(0, 24) // partition size - 1
+  w.Write(0, 6)  // classifications - 1
+  w.Write(0, 8)  // classbook
+  w.Write(0, 3)  // cascade low bits
+  w.WriteBool(false)
+}
+
+// writeSimpleMapping writes a mapping with a single submap that uses floor 0
+// and residue 0 and has no channel coupling.
+func writeSimpleMapping(w *bitWriter) {
+  w.Write(0, 16)     // type
+  w.WriteBool(false) // submaps
+  w.WriteBool(false) // coupling
+  w.Write(0, 2)      // reserved
+  w.Write(0, 8)      // unused time configuration
+  w.Write(0, 8)      // floor
+  w.Write(0, 8)      // residue
+}
+
+// writeFlatFloor1 writes a type 1 floor with no partitions, so its curve is a
+// straight line between the values at 0 and 2^rangebits.
+func writeFlatFloor1(rangebits int) func(w *bitWriter) {
+  return func(w *bitWriter) {
+    w.Write(1, 16)                // type
+    w.Write(0, 5)                 // partitions
+    w.Write(0, 2)                 // multiplier - 1
+    w.Write(uint32(rangebits), 4) // rangebits
+  }
+}
+
+// writeFlatFloor1Packet writes the packet data for a floor written by
+// writeFlatFloor1, a y value of 255 gives a curve of exactly 1.0.
+func writeFlatFloor1Packet(w *bitWriter, used bool, y0, y1 int) {
+  w.WriteBool(used)
+  if used {
+    w.Write(uint32(y0), 8)
+    w.Write(uint32(y1), 8)
+  }
+}
+
+// writeChannelMapping writes a mapping with one submap for each channel, all
+// using floor 0 and residue 0.
+func writeChannelMapping(channels int, couplings [][2]int) func(w *bitWriter) {
+  return func(w *bitWriter) {
+    w.Write(0, 16) // type
+    w.WriteBool(true)
+    w.Write(uint32(channels-1), 4)
+    w.WriteBool(len(couplings) > 0)
+    if len(couplings) > 0 {
+      w.Write(uint32(len(couplings)-1), 8)
+      for _, coupling := range couplings {
+        w.Write(uint32(coupling[0]), ilog(channels-1))
+        w.Write(uint32(coupling[1]), ilog(channels-1))
+      }
+    }
+    w.Write(0, 2) // reserved
+    if channels > 1 {
+      for ch := 0; ch < channels; ch++ {
+        w.Write(uint32(ch), 4)
+      }
+    }
+    for ch := 0; ch < channels; ch++ {
+      w.Write(0, 8)
+      w.Write(0, 8)
+      w.Write(0, 8)
+    }
+  }
+}
+
+// syntheticSpectrumStream builds the headers and a single short block audio
+// packet for the given channel configuration, along with the spectra that the
+// decoder should produce.  Every channel uses a flat floor of exactly 1.0 and
+// a format 1 residue over the first 8 elements of its spectrum, made of two
+// vectors of +/-1 in each of two partitions.
+func syntheticSpectrumStream(channels int, couplings [][2]int, used []bool) ([]byte, []byte, []byte, [][]float64) {
+  // A two entry classbook, every partition uses class 0 since there is only
+  // one classification.
+  classbook := syntheticCodebook{
+    dimensions: 1,
+    lengths:    []int{1, 1},
+  }
+  vqbook := syntheticCodebook{
+    dimensions:    2,
+    lengths:       []int{2, 2, 2, 2},
+    lookup_type:   1,
+    minimum:       -1,
+    delta:         2,
+    value_bits:    1,
+    multiplicands: []uint32{0, 1},
+  }
+  vectors := [][]float64{{-1, -1}, {1, -1}, {-1, 1}, {1, 1}}
+
+  // A format 1 residue over the first 8 elements of the spectrum, in two
+  // partitions of 4.
+  residue := func(w *bitWriter) {
+    w.Write(1, 16) // type
+    w.Write(0, 24) // begin
+    w.Write(8, 24) // end
+    w.Write(3, 24) // partition size - 1
+    w.Write(0, 6)  // classifications - 1
+    w.Write(0, 8)  // classbook
+    w.Write(1, 3)  // class 0 uses a book on pass 0
+    w.WriteBool(false)
+    w.Write(1, 8) // which is the vq book
+  }
+
+  setup := syntheticSetup{
+    codebooks: []syntheticCodebook{classbook, vqbook},
+    floors:    []func(w *bitWriter){writeFlatFloor1(5)},
+    residues:  []func(w *bitWriter){residue},
+    mappings:  []func(w *bitWriter){writeChannelMapping(channels, couplings)},
+    modes:     []syntheticMode{{false, 0}},
+  }
+
+  var w bitWriter
+  w.Write(0, 1) // audio packet, with a single mode there's no mode number
+  for ch := 0; ch < channels; ch++ {
+    writeFlatFloor1Packet(&w, used[ch], 255, 255)
+  }
+
+  decode := make([]bool, channels)
+  copy(decode, used)
+  for _, coupling := range couplings {
+    if decode[coupling[0]] || decode[coupling[1]] {
+      decode[coupling[0]] = true
+      decode[coupling[1]] = true
+    }
+  }
+  residues := make([][]float64, channels)
+  for ch := range residues {
+    residues[ch] = make([]float64, 32)
+    if !decode[ch] {
+      continue
+    }
+    for partition := 0; partition < 2; partition++ {
+      w.WriteCodeword(0, 1)
+      for k := 0; k < 2; k++ {
+        entry := (3*ch + 2*partition + k) % 4
+        w.WriteCodeword(uint32(entry), 2)
+        copy(residues[ch][4*partition+2*k:], vectors[entry])
+      }
+    }
+  }
+
+  for i := len(couplings) - 1; i >= 0; i-- {
+    mag := residues[couplings[i][0]]
+    ang := residues[couplings[i][1]]
+    for j := range mag {
+      M, A := mag[j], ang[j]
+      switch {
+      case M > 0 && A > 0:
+        mag[j], ang[j] = M, M-A
+      case M > 0:
+        mag[j], ang[j] = M+A, M
+      case A > 0:
+        mag[j], ang[j] = M, M+A
+      default:
+        mag[j], ang[j] = M-A, M
+      }
+    }
+  }
+  for ch := range residues {
+    if !used[ch] {
+      residues[ch] = nil
+    }
+  }
+  return syntheticIdHeader(channels, 44100, 64, 64), setup.Bytes(), w.Bytes(), residues
+}
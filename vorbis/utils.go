@@ -4,16 +4,6 @@ import (
   "math"
 )
 
-func iPow(b, e int) int {
-  if e == 0 {
-    return 1
-  }
-  if e%2 == 1 {
-    return b * iPow(b, e-1)
-  }
-  return iPow(b*b, e/2)
-}
-
 func ilog(n uint32) int {
   e := 31
   bit := uint32(1) << 31
@@ -121,26 +111,32 @@ func Lookup1Values(entries, dimensions int) int {
   }
   low := 0
   high := 1
-  for iPow(high, dimensions) <= entries {
+  for powAtMost(high, dimensions, entries) {
     low = high
     high *= 2
   }
-  var mid int
   for high-low > 1 {
-    mid = (high + low) / 2
-    if iPow(mid, dimensions) <= entries {
+    mid := (high + low) / 2
+    if powAtMost(mid, dimensions, entries) {
       low = mid
     } else {
       high = mid
     }
   }
-  if iPow(mid+1, dimensions) <= entries {
-    return mid + 1
-  }
-  if iPow(mid, dimensions) <= entries {
-    return mid
+  return low
+}
+
+// powAtMost returns true if b to the power of e is no more than limit, it
+// stops multiplying as soon as it knows so that large powers don't overflow.
+func powAtMost(b, e, limit int) bool {
+  p := 1
+  for i := 0; i < e; i++ {
+    p *= b
+    if p > limit {
+      return false
+    }
   }
-  return mid - 1
+  return p <= limit
 }
 
 // Translated from some java source somewhere, uses an iterative approach instead of a
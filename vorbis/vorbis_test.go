@@ -3,8 +3,13 @@ package vorbis_test
 import (
   . "gospec"
   "gospec"
+  "ogg"
   "ogg/vorbis"
   "bytes"
+  "errors"
+  "fmt"
+  "math"
+  "math/rand"
   "testing"
 )
 
@@ -35,12 +40,120 @@ func BitReaderSpec(c gospec.Context) {
   //       001 00000000 00000000 00000011 00000
   //  00001
 
-  c.Specify("Bitreader reads from an io.Reader properly", func() {
-    br := vorbis.MakeBitReader(bytes.NewBuffer(v))
+  c.Specify("Bitreader reads from a packet properly", func() {
+    br := vorbis.MakeBitReader(v)
     c.Expect(uint32(0x1), Equals, br.ReadBits(1))
     c.Expect(uint32(0x80), Equals, br.ReadBits(10))
     c.Expect(uint32(0x20000060), Equals, br.ReadBits(32))
     c.Expect(uint32(0x1), Equals, br.ReadBits(5))
+    c.Expect(br.CheckError(), IsNil)
+  })
+
+  c.Specify("Bitreader reads 32 bits at any alignment", func() {
+    data := []byte{0xef, 0xbe, 0xad, 0xde, 0x78, 0x56, 0x34, 0x12, 0xff, 0x00, 0x5a}
+    for skip := 0; skip < 8; skip++ {
+      br := vorbis.MakeBitReader(data)
+      br.ReadBits(skip)
+      c.Expect(br.ReadBits(32), Equals, uint32(uint64(0x78deadbeef)>>uint(skip)))
+      c.Expect(br.ReadBits(32), Equals, uint32(uint64(0x00ff12345678)>>uint(skip)))
+      c.Expect(br.ReadBits(0), Equals, uint32(0))
+      c.Expect(br.CheckError(), IsNil)
+    }
+  })
+
+  c.Specify("Bitreader reads the same bits whatever size the reads are", func() {
+    rng := rand.New(rand.NewSource(5))
+    data := make([]byte, 1000)
+    for i := range data {
+      data[i] = byte(rng.Intn(256))
+    }
+    br := vorbis.MakeBitReader(data)
+    old := vorbis.MakeByteBitReader(bytes.NewBuffer(data))
+    for read := 0; read < 8000-32; {
+      n := rng.Intn(33)
+      c.Expect(br.ReadBits(n), Equals, old.ReadBits(n))
+      read += n
+    }
+  })
+
+  c.Specify("Peek doesn't consume anything", func() {
+    br := vorbis.MakeBitReader(v)
+    bits, available := br.PeekBits(11)
+    c.Expect(bits, Equals, uint32(0x101))
+    c.Expect(available, Equals, 11)
+    br.SkipBits(1)
+    c.Expect(br.ReadBits(10), Equals, uint32(0x80))
+  })
+
+  c.Specify("Peek near the end of the packet pads with zeros", func() {
+    br := vorbis.MakeBitReader([]byte{0xff, 0x81})
+    br.ReadBits(12)
+    bits, available := br.PeekBits(10)
+    c.Expect(bits, Equals, uint32(0x8))
+    c.Expect(available, Equals, 4)
+    c.Expect(br.CheckError(), IsNil)
+  })
+
+  c.Specify("Reading the last bit of a packet isn't an error", func() {
+    br := vorbis.MakeBitReader([]byte{0x80})
+    c.Expect(br.ReadBits(7), Equals, uint32(0))
+    c.Expect(br.ReadBits(1), Equals, uint32(1))
+    c.Expect(br.CheckError(), IsNil)
+  })
+
+  c.Specify("Reading past the end of a packet returns zeros and sticks", func() {
+    br := vorbis.MakeBitReader([]byte{0xff, 0xff})
+    c.Expect(br.ReadBits(12), Equals, uint32(0xfff))
+    c.Expect(br.ReadBits(5), Equals, uint32(0))
+    c.Expect(br.CheckError(), Not(IsNil))
+    c.Expect(br.ReadBits(1), Equals, uint32(0))
+    c.Expect(br.CheckError(), Not(IsNil))
+  })
+
+  c.Specify("Skipping past the end of a packet is an error", func() {
+    br := vorbis.MakeBitReader([]byte{0xff})
+    br.SkipBits(9)
+    c.Expect(br.CheckError(), Not(IsNil))
+    bits, available := br.PeekBits(8)
+    c.Expect(bits, Equals, uint32(0))
+    c.Expect(available, Equals, 0)
+  })
+}
+
+func benchmarkReadBits(b *testing.B, read func(data []byte, widths []int)) {
+  rng := rand.New(rand.NewSource(1))
+  data := make([]byte, 4096)
+  for i := range data {
+    data[i] = byte(rng.Intn(256))
+  }
+  var widths []int
+  for total := 0; total < 8*len(data)-32; {
+    n := 1 + rng.Intn(16)
+    widths = append(widths, n)
+    total += n
+  }
+  b.SetBytes(int64(len(data)))
+  b.ResetTimer()
+  for i := 0; i < b.N; i++ {
+    read(data, widths)
+  }
+}
+
+func BenchmarkReadBits(b *testing.B) {
+  benchmarkReadBits(b, func(data []byte, widths []int) {
+    br := vorbis.MakeBitReader(data)
+    for _, n := range widths {
+      br.ReadBits(n)
+    }
+  })
+}
+
+func BenchmarkReadBitsByteReader(b *testing.B) {
+  benchmarkReadBits(b, func(data []byte, widths []int) {
+    br := vorbis.MakeByteBitReader(bytes.NewBuffer(data))
+    for _, n := range widths {
+      br.ReadBits(n)
+    }
   })
 }
 
@@ -158,7 +271,7 @@ func HuffmanDecodeSpec(c gospec.Context) {
     codebook.AssignCodewords()
 
     v := []uint8{0x5F, 0x6E, 0x2A, 0x00}
-    br := vorbis.MakeBitReader(bytes.NewBuffer(v))
+    br := vorbis.MakeBitReader(v)
 
     c.Expect(codebook.DecodeScalar(br), Equals, 7)
     c.Expect(codebook.DecodeScalar(br), Equals, 6)
@@ -169,4 +282,1042 @@ func HuffmanDecodeSpec(c gospec.Context) {
     c.Expect(codebook.DecodeScalar(br), Equals, 1)
     c.Expect(codebook.DecodeScalar(br), Equals, 0)
   })
+
+  rng := rand.New(rand.NewSource(3))
+  for _, size := range [][2]int{{8, 4}, {64, 10}, {200, 11}, {300, 16}, {1000, 24}} {
+    entries, max_length := size[0], size[1]
+    var codebook vorbis.Codebook
+    codebook.Entries = make([]vorbis.CodebookEntry, entries)
+    for i, length := range randomHuffmanLengths(rng, entries, max_length) {
+      codebook.Entries[i].Length = length
+    }
+    codebook.AssignCodewords()
+    c.Specify(fmt.Sprintf("Huffman decode of %d entries up to %d bits long", entries, max_length), func() {
+      symbols, data := encodeSymbols(rng, &codebook, 2000)
+      br := vorbis.MakeBitReader(data)
+      for _, symbol := range symbols {
+        c.Expect(codebook.DecodeScalar(br), Equals, symbol)
+      }
+      c.Expect(br.CheckError(), IsNil)
+    })
+  }
+
+  c.Specify("Sparse huffman decode", func() {
+    lengths := randomHuffmanLengths(rng, 40, 12)
+    var sparse []int
+    for _, length := range lengths {
+      sparse = append(sparse, length, 0)
+    }
+    var header bitWriter
+    book := syntheticCodebook{dimensions: 1, lengths: sparse, sparse: true}
+    book.write(&header)
+    codebook := vorbis.ReadCodebook(header.Bytes())
+    c.Assume(len(codebook.Entries), Equals, 80)
+    c.Expect(codebook.Entries[1].Unused, IsTrue)
+    symbols, data := encodeSymbols(rng, codebook, 500)
+    br := vorbis.MakeBitReader(data)
+    for _, symbol := range symbols {
+      c.Expect(symbol%2, Equals, 0)
+      c.Expect(codebook.DecodeScalar(br), Equals, symbol)
+    }
+  })
+
+  c.Specify("Ordered huffman decode", func() {
+    // Lengths 2, 3, 3, 3, 5, 5, 5, 5 with no entries of length 4
+    var header bitWriter
+    book := syntheticCodebook{dimensions: 1, lengths: []int{2, 3, 3, 3, 5, 5, 5, 5}, ordered: true}
+    book.write(&header)
+    codebook := vorbis.ReadCodebook(header.Bytes())
+    c.Assume(len(codebook.Entries), Equals, 8)
+    for i, length := range book.lengths {
+      c.Expect(codebook.Entries[i].Length, Equals, length)
+    }
+    symbols, data := encodeSymbols(rng, codebook, 500)
+    br := vorbis.MakeBitReader(data)
+    for _, symbol := range symbols {
+      c.Expect(codebook.DecodeScalar(br), Equals, symbol)
+    }
+  })
+
+  c.Specify("Codebook with a single used entry", func() {
+    var header bitWriter
+    book := syntheticCodebook{dimensions: 1, lengths: []int{0, 0, 3, 0}, sparse: true}
+    book.write(&header)
+    codebook := vorbis.ReadCodebook(header.Bytes())
+
+    var packet bitWriter
+    packet.Write(0, 3)
+    packet.Write(5, 3)
+    packet.Write(0x2a, 6)
+    br := vorbis.MakeBitReader(packet.Bytes())
+    c.Expect(codebook.DecodeScalar(br), Equals, 2)
+    c.Expect(codebook.DecodeScalar(br), Equals, 2)
+    c.Expect(br.ReadBits(6), Equals, uint32(0x2a))
+  })
+
+  c.Specify("Codebook with a single zero-bit entry reads nothing", func() {
+    var codebook vorbis.Codebook
+    codebook.Entries = make([]vorbis.CodebookEntry, 1)
+    codebook.AssignCodewords()
+    br := vorbis.MakeBitReader([]byte{0xa5})
+    c.Expect(codebook.DecodeScalar(br), Equals, 0)
+    c.Expect(br.ReadBits(8), Equals, uint32(0xa5))
+  })
+
+  c.Specify("Huffman decode stops at the end of the packet", func() {
+    var codebook vorbis.Codebook
+    codebook.Entries = make([]vorbis.CodebookEntry, 300)
+    for i, length := range randomHuffmanLengths(rng, 300, 16) {
+      codebook.Entries[i].Length = length
+    }
+    codebook.AssignCodewords()
+    symbols, data := encodeSymbols(rng, &codebook, 100)
+    // Cutting off the last byte must lose at least the last symbol
+    br := vorbis.MakeBitReader(data[0 : len(data)-1])
+    decoded := 0
+    for codebook.DecodeScalar(br) >= 0 {
+      decoded++
+    }
+    c.Expect(decoded < len(symbols), IsTrue)
+    c.Expect(br.CheckError(), Not(IsNil))
+    c.Expect(codebook.DecodeScalar(br), Equals, -1)
+  })
+}
+
+// randomHuffmanLengths returns the codeword lengths of a random, complete
+// huffman tree.  Leaves that were split recently are more likely to be split
+// again so that there are some long codewords.
+func randomHuffmanLengths(rng *rand.Rand, entries, max_length int) []int {
+  lengths := []int{0}
+  for len(lengths) < entries {
+    i := len(lengths) - 1 - rng.Intn(len(lengths))%4
+    if lengths[i] >= max_length {
+      i = rng.Intn(len(lengths))
+    }
+    if lengths[i] >= max_length {
+      continue
+    }
+    lengths[i]++
+    lengths = append(lengths, lengths[i])
+  }
+  for i := range lengths {
+    j := i + rng.Intn(len(lengths)-i)
+    lengths[i], lengths[j] = lengths[j], lengths[i]
+  }
+  return lengths
+}
+
+// encodeSymbols writes n random codewords from codebook
+func encodeSymbols(rng *rand.Rand, codebook *vorbis.Codebook, n int) ([]int, []byte) {
+  var w bitWriter
+  symbols := make([]int, n)
+  for i := range symbols {
+    symbol := rng.Intn(len(codebook.Entries))
+    for codebook.Entries[symbol].Unused {
+      symbol = rng.Intn(len(codebook.Entries))
+    }
+    symbols[i] = symbol
+    w.WriteCodeword(codebook.Entries[symbol].Codeword, codebook.Entries[symbol].Length)
+  }
+  return symbols, w.Bytes()
+}
+
+func BenchmarkDecodeScalar(b *testing.B) {
+  rng := rand.New(rand.NewSource(1))
+  var codebook vorbis.Codebook
+  codebook.Entries = make([]vorbis.CodebookEntry, 256)
+  for i, length := range randomHuffmanLengths(rng, 256, 16) {
+    codebook.Entries[i].Length = length
+  }
+  codebook.AssignCodewords()
+  symbols, data := encodeSymbols(rng, &codebook, 4096)
+  b.SetBytes(int64(len(data)))
+  b.ResetTimer()
+  for i := 0; i < b.N; i++ {
+    br := vorbis.MakeBitReader(data)
+    for j := 0; j < len(symbols); j++ {
+      codebook.DecodeScalar(br)
+    }
+  }
+}
+
+// Straight from the definition in the spec, O(n^2)
+func directIMDCT(in []float64) []float64 {
+  n := 2 * len(in)
+  out := make([]float64, n)
+  for j := range out {
+    sum := 0.0
+    for k, x := range in {
+      sum += x * math.Cos(2*math.Pi/float64(n)*(float64(j)+0.5+float64(n)/4)*(float64(k)+0.5))
+    }
+    out[j] = sum
+  }
+  return out
+}
+
+func IMDCTSpec(c gospec.Context) {
+  rng := rand.New(rand.NewSource(1))
+  for n := 64; n <= 8192; n *= 2 {
+    in := make([]float64, n/2)
+    for i := range in {
+      in[i] = rng.Float64()*2 - 1
+    }
+    fast := vorbis.InverseMDCT(in)
+    slow := directIMDCT(in)
+    c.Specify(fmt.Sprintf("Inverse MDCT matches the direct formula for n = %d", n), func() {
+      c.Expect(len(fast), Equals, n)
+      max_err := 0.0
+      for i := range slow {
+        max_err = math.Max(max_err, math.Abs(fast[i]-slow[i]))
+      }
+      c.Expect(max_err, IsWithin(1e-9), 0.0)
+    })
+  }
+
+  c.Specify("Inverse MDCT of a single coefficient is a cosine", func() {
+    in := make([]float64, 32)
+    in[3] = 1
+    out := vorbis.InverseMDCT(in)
+    for j := range out {
+      expected := math.Cos(2 * math.Pi / 64 * (float64(j) + 0.5 + 16) * 3.5)
+      c.Expect(out[j], IsWithin(1e-12), expected)
+    }
+  })
+}
+
+func BenchmarkInverseMDCT2048(b *testing.B) {
+  in := make([]float64, 1024)
+  for i := range in {
+    in[i] = float64(i%7) - 3
+  }
+  for i := 0; i < b.N; i++ {
+    vorbis.InverseMDCT(in)
+  }
+}
+
+// Forward MDCT scaled by 4/n so that it is exactly inverted by the decoder's
+// inverse MDCT, windowing and overlap-add.
+func directMDCT(in []float64) []float64 {
+  n := len(in)
+  out := make([]float64, n/2)
+  for k := range out {
+    sum := 0.0
+    for j, x := range in {
+      sum += x * math.Cos(2*math.Pi/float64(n)*(float64(j)+0.5+float64(n)/4)*(float64(k)+0.5))
+    }
+    out[k] = sum * 4 / float64(n)
+  }
+  return out
+}
+
+func WindowSpec(c gospec.Context) {
+  c.Specify("Windows are zero outside of their slopes and one between them", func() {
+    w := vorbis.Window(64, 512, true, false, false)
+    c.Expect(len(w), Equals, 512)
+    c.Expect(w[512/4-64/4-1], Equals, 0.0)
+    c.Expect(w[512/4+64/4], Equals, 1.0)
+    c.Expect(w[512*3/4-64/4-1], Equals, 1.0)
+    c.Expect(w[512*3/4+64/4], Equals, 0.0)
+
+    w = vorbis.Window(64, 512, true, true, true)
+    c.Expect(w[0] > 0, IsTrue)
+    c.Expect(w[256] < 1, IsTrue)
+    c.Expect(w[511] > 0, IsTrue)
+
+    w = vorbis.Window(64, 512, false, false, false)
+    c.Expect(len(w), Equals, 64)
+    c.Expect(w[0] > 0, IsTrue)
+    c.Expect(w[63] > 0, IsTrue)
+  })
+
+  c.Specify("Windows are symmetric", func() {
+    for _, flags := range [][2]bool{{false, false}, {true, true}} {
+      w := vorbis.Window(256, 2048, true, flags[0], flags[1])
+      for i := range w {
+        c.Expect(w[i], IsWithin(1e-12), w[len(w)-1-i])
+      }
+    }
+  })
+
+  c.Specify("Overlapping slopes are power complementary", func() {
+    w := vorbis.Window(64, 512, false, false, false)
+    for i := 0; i < 32; i++ {
+      c.Expect(w[i]*w[i]+w[i+32]*w[i+32], IsWithin(1e-12), 1.0)
+    }
+  })
+}
+
+func SynthesisSpec(c gospec.Context) {
+  // Chop a signal into blocks the same way an encoder would, including every
+  // combination of long and short neighbours, and check that the decoder's
+  // synthesis stages put the signal back together again.
+  const blocksize_0 = 64
+  const blocksize_1 = 256
+  long := []bool{false, true, true, false, false, true, false, true, true, true, false}
+  centers := make([]int, len(long))
+  size := func(i int) int {
+    if long[i] {
+      return blocksize_1
+    }
+    return blocksize_0
+  }
+  centers[0] = blocksize_1 / 2
+  for i := 1; i < len(long); i++ {
+    centers[i] = centers[i-1] + size(i-1)/4 + size(i)/4
+  }
+  last := len(long) - 1
+  signal := make([]float64, centers[last]+size(last)/2)
+  rng := rand.New(rand.NewSource(2))
+  for i := range signal {
+    signal[i] = rng.Float64()*2 - 1
+  }
+
+  spectra := make([][]float64, len(long))
+  for i := range long {
+    n := size(i)
+    prev := i > 0 && long[i-1]
+    next := i < last && long[i+1]
+    window := vorbis.Window(blocksize_0, blocksize_1, long[i], prev, next)
+    block := make([]float64, n)
+    copy(block, signal[centers[i]-n/2:])
+    for j := range block {
+      block[j] *= window[j]
+    }
+    spectra[i] = directMDCT(block)
+  }
+
+  output := vorbis.Synthesize(blocksize_0, blocksize_1, long, spectra)
+  c.Specify("Synthesis produces the correct number of samples", func() {
+    c.Expect(len(output), Equals, centers[last]-centers[0])
+  })
+  c.Specify("Synthesis reconstructs the original signal", func() {
+    max_err := 0.0
+    for i := range output {
+      max_err = math.Max(max_err, math.Abs(output[i]-signal[centers[0]+i]))
+    }
+    c.Expect(max_err, IsWithin(1e-9), 0.0)
+  })
+}
+
+// Floor 0 curve computed directly from the formulas in the spec
+func referenceFloor0(rate, bark_map_size, amplitude_bits, amplitude_offset, amplitude int, coefficients []float64, n int) []float64 {
+  bark := func(x float64) float64 {
+    return 13.1*math.Atan(0.00074*x) + 2.24*math.Atan(0.0000000185*x*x) + 0.0001*x
+  }
+  order := len(coefficients)
+  curve := make([]float64, n)
+  for i := range curve {
+    bark_map := math.Floor(bark(float64(rate)*float64(i)/(2*float64(n))) * float64(bark_map_size) / bark(0.5*float64(rate)))
+    bark_map = math.Min(bark_map, float64(bark_map_size-1))
+    cos_omega := math.Cos(math.Pi * bark_map / float64(bark_map_size))
+    var p, q float64
+    if order%2 == 1 {
+      p = 1 - cos_omega*cos_omega
+      for j := 0; j <= (order-3)/2; j++ {
+        p *= 4 * math.Pow(math.Cos(coefficients[2*j+1])-cos_omega, 2)
+      }
+      q = 0.25
+      for j := 0; j <= (order-1)/2; j++ {
+        q *= 4 * math.Pow(math.Cos(coefficients[2*j])-cos_omega, 2)
+      }
+    } else {
+      p = (1 - cos_omega) / 2
+      for j := 0; j <= (order-2)/2; j++ {
+        p *= 4 * math.Pow(math.Cos(coefficients[2*j+1])-cos_omega, 2)
+      }
+      q = (1 + cos_omega) / 2
+      for j := 0; j <= (order-2)/2; j++ {
+        q *= 4 * math.Pow(math.Cos(coefficients[2*j])-cos_omega, 2)
+      }
+    }
+    max_amplitude := math.Pow(2, float64(amplitude_bits)) - 1
+    curve[i] = math.Exp(0.11512925 * (float64(amplitude*amplitude_offset)/(max_amplitude*math.Sqrt(p+q)) - float64(amplitude_offset)))
+  }
+  return curve
+}
+
+func Floor0Spec(c gospec.Context) {
+  // A 2 dimensional VQ codebook with the values 0.25 and 0.75 in each
+  // dimension:
+  //   entry 0: (0.25, 0.25)  codeword 00
+  //   entry 1: (0.75, 0.25)  codeword 01
+  //   entry 2: (0.25, 0.75)  codeword 10
+  //   entry 3: (0.75, 0.75)  codeword 11
+  book := syntheticCodebook{
+    dimensions:    2,
+    lengths:       []int{2, 2, 2, 2},
+    lookup_type:   1,
+    minimum:       0.25,
+    delta:         0.5,
+    value_bits:    1,
+    multiplicands: []uint32{0, 1},
+  }
+  floor0 := func(order int) func(w *bitWriter) {
+    return func(w *bitWriter) {
+      w.Write(0, 16)            // type
+      w.Write(uint32(order), 8) // order
+      w.Write(44100, 16)        // rate
+      w.Write(256, 16)          // bark map size
+      w.Write(6, 6)             // amplitude bits
+      w.Write(100, 8)           // amplitude offset
+      w.Write(1, 4)             // number of books - 1
+      w.Write(1, 8)             // book 0 is codebook 1
+      w.Write(0, 8)             // book 1 is codebook 0
+    }
+  }
+  setup := syntheticSetup{
+    codebooks: []syntheticCodebook{book, book},
+    floors:    []func(w *bitWriter){floor0(4), floor0(3)},
+    residues:  []func(w *bitWriter){writeEmptyResidue},
+    mappings:  []func(w *bitWriter){writeSimpleMapping},
+    modes:     []syntheticMode{{false, 0}},
+  }
+  id := syntheticIdHeader(1, 44100, 256, 2048)
+
+  var packet bitWriter
+  packet.Write(40, 6)        // amplitude
+  packet.Write(1, 2)         // book 1, ilog(2) bits
+  packet.WriteCodeword(1, 2) // (0.75, 0.25)
+  packet.WriteCodeword(2, 2) // (0.25, 0.75) + 0.25
+  coefficients := []float64{0.75, 0.25, 0.5, 1.0}
+
+  for _, n := range []int{128, 1024} {
+    c.Specify(fmt.Sprintf("Even order floor 0 curve matches the spec for n = %d", n), func() {
+      curve := vorbis.DecodeFloor(id, setup.Bytes(), packet.Bytes(), 0, n)
+      expected := referenceFloor0(44100, 256, 6, 100, 40, coefficients, n)
+      c.Assume(len(curve), Equals, n)
+      for i := range curve {
+        c.Expect(curve[i], IsWithin(1e-9*expected[i]), expected[i])
+      }
+    })
+    c.Specify(fmt.Sprintf("Odd order floor 0 curve matches the spec for n = %d", n), func() {
+      curve := vorbis.DecodeFloor(id, setup.Bytes(), packet.Bytes(), 1, n)
+      expected := referenceFloor0(44100, 256, 6, 100, 40, coefficients[0:3], n)
+      c.Assume(len(curve), Equals, n)
+      for i := range curve {
+        c.Expect(curve[i], IsWithin(1e-9*expected[i]), expected[i])
+      }
+    })
+  }
+
+  c.Specify("Floor 0 with zero amplitude is unused", func() {
+    var packet bitWriter
+    packet.Write(0, 6)
+    c.Expect(vorbis.DecodeFloor(id, setup.Bytes(), packet.Bytes(), 0, 128) == nil, IsTrue)
+  })
+
+  c.Specify("Floor 0 with an out of range book is unused", func() {
+    var packet bitWriter
+    packet.Write(40, 6)
+    bad := syntheticSetup{
+      codebooks: []syntheticCodebook{book},
+      floors: []func(w *bitWriter){func(w *bitWriter) {
+        w.Write(0, 16)
+        w.Write(2, 8)
+        w.Write(44100, 16)
+        w.Write(256, 16)
+        w.Write(6, 6)
+        w.Write(100, 8)
+        w.Write(2, 4) // three books, so the book number takes two bits
+        w.Write(0, 8)
+        w.Write(0, 8)
+        w.Write(0, 8)
+      }},
+      residues: []func(w *bitWriter){writeEmptyResidue},
+      mappings: []func(w *bitWriter){writeSimpleMapping},
+      modes:    []syntheticMode{{false, 0}},
+    }
+    packet.Write(3, 2)
+    packet.WriteCodeword(0, 2)
+    c.Expect(vorbis.DecodeFloor(id, bad.Bytes(), packet.Bytes(), 0, 128) == nil, IsTrue)
+  })
+}
+
+func CodebookLookupSpec(c gospec.Context) {
+  c.Specify("Lookup type 1 codebooks", func() {
+    var book vorbis.Codebook
+    book.Dimensions = 2
+    book.Entries = make([]vorbis.CodebookEntry, 9)
+    book.Multiplicands = []uint32{0, 1, 2}
+    book.Minimum_value = -1
+    book.Delta_value = 1
+    book.BuildVQType1()
+    c.Expect(book.Value_vectors[0], Equals, []float64{-1, -1})
+    c.Expect(book.Value_vectors[1], Equals, []float64{0, -1})
+    c.Expect(book.Value_vectors[5], Equals, []float64{1, 0})
+    c.Expect(book.Value_vectors[8], Equals, []float64{1, 1})
+  })
+
+  c.Specify("Lookup type 1 codebooks with sequence_p", func() {
+    var book vorbis.Codebook
+    book.Dimensions = 2
+    book.Entries = make([]vorbis.CodebookEntry, 9)
+    book.Multiplicands = []uint32{0, 1, 2}
+    book.Minimum_value = -1
+    book.Delta_value = 1
+    book.Sequence_p = true
+    book.BuildVQType1()
+    c.Expect(book.Value_vectors[5], Equals, []float64{1, 1})
+    c.Expect(book.Value_vectors[8], Equals, []float64{1, 2})
+  })
+
+  c.Specify("Lookup type 2 codebooks", func() {
+    var book vorbis.Codebook
+    book.Dimensions = 2
+    book.Entries = make([]vorbis.CodebookEntry, 3)
+    book.Multiplicands = []uint32{0, 1, 2, 3, 4, 5}
+    book.Minimum_value = 0.5
+    book.Delta_value = 2
+    book.Sequence_p = true
+    book.BuildVQType2()
+    c.Expect(book.Value_vectors[0], Equals, []float64{0.5, 3})
+    c.Expect(book.Value_vectors[2], Equals, []float64{8.5, 19})
+  })
+}
+
+func SpectrumSpec(c gospec.Context) {
+  check := func(channels int, couplings [][2]int, used []bool) {
+    id, setup, packet, expected := syntheticSpectrumStream(channels, couplings, used)
+    spectra, _ := vorbis.DecodeSpectra(id, setup, packet)
+    c.Assume(len(spectra), Equals, channels)
+    for ch := range spectra {
+      c.Expect(spectra[ch], Equals, expected[ch])
+    }
+  }
+
+  c.Specify("Mono spectrum is floor times residue", func() {
+    check(1, nil, []bool{true})
+  })
+  c.Specify("Unused mono channels have no spectrum", func() {
+    check(1, nil, []bool{false})
+  })
+  c.Specify("Stereo spectra are inverse coupled", func() {
+    check(2, [][2]int{{0, 1}}, []bool{true, true})
+  })
+  c.Specify("Coupled channels with an unused floor still have their residue decoded", func() {
+    check(2, [][2]int{{0, 1}}, []bool{true, false})
+    check(2, [][2]int{{0, 1}}, []bool{false, true})
+  })
+  c.Specify("Couplings are undone in reverse order", func() {
+    check(3, [][2]int{{0, 1}, {1, 2}}, []bool{true, true, true})
+  })
+  c.Specify("5.1 spectra", func() {
+    check(6, [][2]int{{0, 2}, {3, 4}}, []bool{true, true, true, true, true, false})
+  })
+  c.Specify("7.1 spectra", func() {
+    check(8, [][2]int{{0, 2}, {3, 4}, {5, 6}}, []bool{true, true, true, true, true, true, true, false})
+  })
+}
+
+func TruncatedPacketSpec(c gospec.Context) {
+  // The mono packet from syntheticSpectrumStream is laid out as:
+  //   bit  0      packet type
+  //   bits 1-17   floor
+  //   bits 18-22  first partition, a classword and two vectors
+  //   bits 23-27  second partition
+  id, setup, packet, expected := syntheticSpectrumStream(1, nil, []bool{true})
+  c.Assume(len(packet), Equals, 4)
+
+  c.Specify("An empty packet is discarded", func() {
+    _, ok := vorbis.DecodeSpectra(id, setup, nil)
+    c.Expect(ok, IsFalse)
+  })
+
+  c.Specify("A packet that ends during floor decode zeroes every channel", func() {
+    spectra, ok := vorbis.DecodeSpectra(id, setup, packet[0:1])
+    c.Expect(ok, IsTrue)
+    c.Expect(len(spectra), Equals, 1)
+    c.Expect(spectra[0] == nil, IsTrue)
+
+    spectra, ok = vorbis.DecodeSpectra(id, setup, packet[0:2])
+    c.Expect(ok, IsTrue)
+    c.Expect(spectra[0] == nil, IsTrue)
+  })
+
+  c.Specify("A packet that ends during residue decode keeps what was decoded", func() {
+    spectra, ok := vorbis.DecodeSpectra(id, setup, packet[0:3])
+    c.Expect(ok, IsTrue)
+    partial := make([]float64, 32)
+    copy(partial, expected[0][0:4])
+    c.Expect(spectra[0], Equals, partial)
+  })
+
+  c.Specify("A complete packet is decoded entirely", func() {
+    spectra, ok := vorbis.DecodeSpectra(id, setup, packet)
+    c.Expect(ok, IsTrue)
+    c.Expect(spectra[0], Equals, expected[0])
+  })
+
+  c.Specify("Truncated multichannel packets never panic", func() {
+    id, setup, packet, _ := syntheticSpectrumStream(6, [][2]int{{0, 2}, {3, 4}}, []bool{true, true, true, true, true, false})
+    for i := 0; i <= len(packet); i++ {
+      spectra, ok := vorbis.DecodeSpectra(id, setup, packet[0:i])
+      c.Expect(ok, Equals, i > 0)
+      if ok {
+        c.Expect(len(spectra), Equals, 6)
+      }
+    }
+  })
+}
+
+// syntheticResidue describes a residue that uses the classbook and vq books
+// from residueCodebooks, along with enough of an encoder to write packets for
+// it.
+type syntheticResidue struct {
+  format         int
+  begin, end     int
+  partition_size int
+}
+
+// Codebook 0 is the classbook, two classifications per codeword.  Codebook 1
+// has two dimensional vectors of +/-1 and codebook 2 has four dimensional
+// vectors of 0.25 or 0.75.
+var residueCodebooks = []syntheticCodebook{
+  {dimensions: 2, lengths: repeatInt(4, 16)},
+  {dimensions: 2, lengths: repeatInt(2, 4), lookup_type: 1, minimum: -1, delta: 2, value_bits: 1, multiplicands: []uint32{0, 1}},
+  {dimensions: 4, lengths: repeatInt(4, 16), lookup_type: 1, minimum: 0.25, delta: 0.5, value_bits: 1, multiplicands: []uint32{0, 1}},
+}
+
+// residueBooks[classification][pass] is the vq book used for that pass, or
+// -1 if there isn't one.
+var residueBooks = [4][8]int{
+  {-1, -1, -1, -1, -1, -1, -1, -1},
+  {1, -1, -1, -1, -1, -1, -1, -1},
+  {2, -1, 1, -1, -1, -1, -1, -1},
+  {-1, 1, -1, 2, -1, -1, -1, -1},
+}
+
+func repeatInt(v, n int) []int {
+  s := make([]int, n)
+  for i := range s {
+    s[i] = v
+  }
+  return s
+}
+
+func (r syntheticResidue) write(w *bitWriter) {
+  w.Write(uint32(r.format), 16)
+  w.Write(uint32(r.begin), 24)
+  w.Write(uint32(r.end), 24)
+  w.Write(uint32(r.partition_size-1), 24)
+  w.Write(3, 6) // classifications - 1
+  w.Write(0, 8) // classbook
+  for _, books := range residueBooks {
+    cascade := 0
+    for pass, book := range books {
+      if book != -1 {
+        cascade |= 1 << uint(pass)
+      }
+    }
+    w.Write(uint32(cascade&7), 3)
+    w.WriteBool(cascade > 7)
+    if cascade > 7 {
+      w.Write(uint32(cascade>>3), 5)
+    }
+  }
+  for _, books := range residueBooks {
+    for _, book := range books {
+      if book != -1 {
+        w.Write(uint32(book), 8)
+      }
+    }
+  }
+}
+
+// encode writes random residue data for vectors of size n, following the
+// decode procedure in the spec, and returns the vectors that it encodes.
+func (r syntheticResidue) encode(w *bitWriter, rng *rand.Rand, do_not_decode []bool, n int) [][]float64 {
+  if r.format == 2 {
+    decode := false
+    for _, skip := range do_not_decode {
+      decode = decode || !skip
+    }
+    ch := len(do_not_decode)
+    interleaved := make([]float64, ch*n)
+    if decode {
+      format1 := r
+      format1.format = 1
+      interleaved = format1.encode(w, rng, []bool{false}, ch*n)[0]
+    }
+    vecs := make([][]float64, ch)
+    for j := range vecs {
+      vecs[j] = make([]float64, n)
+      for i := range vecs[j] {
+        vecs[j][i] = interleaved[i*ch+j]
+      }
+    }
+    return vecs
+  }
+
+  begin, end := r.begin, r.end
+  if begin > n {
+    begin = n
+  }
+  if end > n {
+    end = n
+  }
+  partitions := (end - begin) / r.partition_size
+
+  vecs := make([][]float64, len(do_not_decode))
+  classifications := make([][]int, len(do_not_decode))
+  for j := range vecs {
+    vecs[j] = make([]float64, n)
+    classifications[j] = make([]int, partitions+1)
+    for i := range classifications[j] {
+      classifications[j][i] = rng.Intn(4)
+    }
+  }
+
+  for pass := 0; pass < 8; pass++ {
+    for partition := 0; partition < partitions; partition += 2 {
+      if pass == 0 {
+        for j := range vecs {
+          if !do_not_decode[j] {
+            w.WriteCodeword(uint32(classifications[j][partition]*4+classifications[j][partition+1]), 4)
+          }
+        }
+      }
+      for p := partition; p < partition+2 && p < partitions; p++ {
+        for j := range vecs {
+          book := residueBooks[classifications[j][p]][pass]
+          if do_not_decode[j] || book == -1 {
+            continue
+          }
+          dimensions := residueCodebooks[book].dimensions
+          step := r.partition_size / dimensions
+          for i := 0; i < step; i++ {
+            entry := rng.Intn(len(residueCodebooks[book].lengths))
+            w.WriteCodeword(uint32(entry), residueCodebooks[book].lengths[entry])
+            for k := 0; k < dimensions; k++ {
+              value := residueCodebooks[book].minimum
+              if entry&(1<<uint(k)) != 0 {
+                value += residueCodebooks[book].delta
+              }
+              offset := begin + p*r.partition_size
+              if r.format == 0 {
+                vecs[j][offset+i+k*step] += value
+              } else {
+                vecs[j][offset+i*dimensions+k] += value
+              }
+            }
+          }
+        }
+      }
+    }
+  }
+  return vecs
+}
+
+func ResidueSpec(c gospec.Context) {
+  rng := rand.New(rand.NewSource(7))
+  id := syntheticIdHeader(1, 44100, 64, 64)
+  residues := []syntheticResidue{
+    {0, 0, 32, 4},
+    {0, 4, 28, 8},
+    {0, 6, 30, 8},
+    {0, 8, 100, 12},
+    {0, 16, 16, 4},
+  }
+  skips := [][]bool{
+    {false},
+    {false, false},
+    {true, false},
+    {false, true, false},
+    {true, true},
+  }
+  for format := 0; format <= 2; format++ {
+    for _, residue := range residues {
+      residue.format = format
+      setup := syntheticSetup{
+        codebooks: residueCodebooks,
+        floors:    []func(w *bitWriter){writeFlatFloor1(5)},
+        residues:  []func(w *bitWriter){residue.write},
+        mappings:  []func(w *bitWriter){writeSimpleMapping},
+        modes:     []syntheticMode{{false, 0}},
+      }
+      for _, skip := range skips {
+        var packet bitWriter
+        expected := residue.encode(&packet, rng, skip, 32)
+        name := fmt.Sprintf("Format %d residue over [%d, %d) in partitions of %d with %d channels matches the spec",
+          format, residue.begin, residue.end, residue.partition_size, len(skip))
+        c.Specify(name, func() {
+          vecs := vorbis.DecodeResidue(id, setup.Bytes(), packet.Bytes(), 0, skip, 32)
+          c.Expect(vecs, Equals, expected)
+        })
+      }
+    }
+  }
+}
+
+func ConcurrentDecodeSpec(c gospec.Context) {
+  c.Specify("Decoders running in parallel don't interfere with each other", func() {
+    // Run with -race, each decode has its own decoder so the only state they
+    // share is read only.
+    id, setup, packet, expected := syntheticSpectrumStream(6, [][2]int{{0, 2}, {3, 4}}, []bool{true, true, true, true, true, false})
+    results := make(chan [][]float64)
+    for i := 0; i < 16; i++ {
+      go func() {
+        var spectra [][]float64
+        for j := 0; j < 20; j++ {
+          spectra, _ = vorbis.DecodeSpectra(id, setup, packet)
+        }
+        results <- spectra
+      }()
+    }
+    for i := 0; i < 16; i++ {
+      c.Expect(<-results, Equals, expected)
+    }
+  })
+}
+
+// oggStream puts each packet on a page of its own in an Ogg bitstream
+func oggStream(packets ...[]byte) []byte {
+  out := bytes.NewBuffer(nil)
+  w := ogg.NewWriter(out, 1)
+  for _, packet := range packets {
+    w.WritePacket(packet, 0)
+    w.Flush()
+  }
+  w.Close()
+  return out.Bytes()
+}
+
+func HeaderErrorSpec(c gospec.Context) {
+  id, setup, _, _ := syntheticSpectrumStream(1, nil, []bool{true})
+  comment := syntheticCommentHeader("vendor", "TITLE=test")
+
+  // headerError makes a decoder from the given headers and returns the
+  // HeaderError it fails with, or nil if it doesn't fail with one.
+  headerError := func(id, comment, setup []byte) *vorbis.HeaderError {
+    _, err := vorbis.NewDecoder(bytes.NewReader(oggStream(id, comment, setup)))
+    var header_err *vorbis.HeaderError
+    if !errors.As(err, &header_err) {
+      return nil
+    }
+    return header_err
+  }
+
+  // withSetup returns the setup header of simpleSetup after edit has
+  // changed it.
+  withSetup := func(edit func(s *syntheticSetup)) []byte {
+    s := simpleSetup()
+    edit(&s)
+    return s.Bytes()
+  }
+
+  c.Specify("Valid headers make a decoder", func() {
+    _, err := vorbis.NewDecoder(bytes.NewReader(oggStream(id, comment, setup)))
+    c.Expect(err, Equals, nil)
+    c.Expect(headerError(id, comment, withSetup(func(s *syntheticSetup) {})) == nil, IsTrue)
+  })
+
+  c.Specify("Invalid blocksizes are reported", func() {
+    err := headerError(syntheticIdHeader(1, 44100, 32, 64), comment, setup)
+    c.Assume(err != nil, IsTrue)
+    c.Expect(err.Err, Equals, vorbis.ErrBlocksize)
+    c.Expect(err.Header, Equals, "id")
+    err = headerError(syntheticIdHeader(1, 44100, 128, 64), comment, setup)
+    c.Assume(err != nil, IsTrue)
+    c.Expect(err.Err, Equals, vorbis.ErrBlocksize)
+  })
+
+  c.Specify("Bad framing is reported", func() {
+    bad_id := append([]byte(nil), id...)
+    bad_id[len(bad_id)-1] = 0
+    err := headerError(bad_id, comment, setup)
+    c.Assume(err != nil, IsTrue)
+    c.Expect(err.Err, Equals, vorbis.ErrFraming)
+    bad_comment := append([]byte(nil), comment...)
+    bad_comment[len(bad_comment)-1] = 0
+    err = headerError(id, bad_comment, setup)
+    c.Assume(err != nil, IsTrue)
+    c.Expect(err.Err, Equals, vorbis.ErrFraming)
+    c.Expect(err.Header, Equals, "comment")
+  })
+
+  c.Specify("Other invalid id header fields are reported", func() {
+    err := headerError(syntheticIdHeader(0, 44100, 64, 64), comment, setup)
+    c.Assume(err != nil, IsTrue)
+    c.Expect(err.Err, Equals, vorbis.ErrInvalidValue)
+    bad_id := append([]byte(nil), id...)
+    bad_id[7] = 1
+    err = headerError(bad_id, comment, setup)
+    c.Assume(err != nil, IsTrue)
+    c.Expect(err.Err, Equals, vorbis.ErrVersion)
+    err = headerError(comment, comment, setup)
+    c.Assume(err != nil, IsTrue)
+    c.Expect(err.Err, Equals, vorbis.ErrNotVorbis)
+  })
+
+  c.Specify("Comment lengths longer than the packet are reported", func() {
+    bad_comment := append([]byte(nil), comment...)
+    bad_comment[10] = 0x7f
+    err := headerError(id, bad_comment, setup)
+    c.Assume(err != nil, IsTrue)
+    c.Expect(err.Err, Equals, vorbis.ErrTruncatedHeader)
+  })
+
+  c.Specify("A missing codebook sync pattern is reported", func() {
+    bad_setup := append([]byte(nil), setup...)
+    bad_setup[8] = 0
+    err := headerError(id, comment, bad_setup)
+    c.Assume(err != nil, IsTrue)
+    c.Expect(err.Err, Equals, vorbis.ErrCodebookSync)
+    c.Expect(err.Field, Equals, "codebook 0 sync pattern")
+  })
+
+  c.Specify("An overspecified codebook is reported", func() {
+    err := headerError(id, comment, withSetup(func(s *syntheticSetup) {
+      s.codebooks[0].lengths = []int{1, 1, 1}
+    }))
+    c.Assume(err != nil, IsTrue)
+    c.Expect(err.Err, Equals, vorbis.ErrCodebook)
+  })
+
+  c.Specify("Out of range indices are reported", func() {
+    edits := map[string]func(s *syntheticSetup){
+      "mode 0 mapping": func(s *syntheticSetup) {
+        s.modes[0].mapping = 1
+      },
+      "mapping 0 submap floor": func(s *syntheticSetup) {
+        s.mappings[0] = func(w *bitWriter) {
+          w.Write(0, 16)
+          w.WriteBool(false)
+          w.WriteBool(false)
+          w.Write(0, 2)
+          w.Write(0, 8)
+          w.Write(1, 8)
+          w.Write(0, 8)
+        }
+      },
+      "mapping 0 submap residue": func(s *syntheticSetup) {
+        s.mappings[0] = func(w *bitWriter) {
+          w.Write(0, 16)
+          w.WriteBool(false)
+          w.WriteBool(false)
+          w.Write(0, 2)
+          w.Write(0, 8)
+          w.Write(0, 8)
+          w.Write(3, 8)
+        }
+      },
+      "residue 0 classbook": func(s *syntheticSetup) {
+        s.residues[0] = func(w *bitWriter) {
+          w.Write(0, 16)
+          w.Write(0, 24)
+          w.Write(0, 24)
+          w.Write(0, 24)
+          w.Write(0, 6)
+          w.Write(2, 8)
+          w.Write(0, 3)
+          w.WriteBool(false)
+        }
+      },
+      "residue 0 book": func(s *syntheticSetup) {
+        s.residues[0] = func(w *bitWriter) {
+          w.Write(0, 16)
+          w.Write(0, 24)
+          w.Write(0, 24)
+          w.Write(0, 24)
+          w.Write(0, 6)
+          w.Write(0, 8)
+          w.Write(1, 3)
+          w.WriteBool(false)
+          w.Write(7, 8)
+        }
+      },
+      "floor 0 floor 1 masterbook": func(s *syntheticSetup) {
+        s.floors[0] = func(w *bitWriter) {
+          w.Write(1, 16)
+          w.Write(1, 5) // one partition
+          w.Write(0, 4) // of class 0
+          w.Write(0, 3) // dimensions - 1
+          w.Write(1, 2) // subclasses
+          w.Write(9, 8) // masterbook
+        }
+      },
+    }
+    for field, edit := range edits {
+      err := headerError(id, comment, withSetup(edit))
+      c.Assume(err != nil, IsTrue)
+      c.Expect(err.Err, Equals, vorbis.ErrOutOfRange)
+      c.Expect(err.Field, Equals, field)
+      c.Expect(err.Header, Equals, "setup")
+    }
+  })
+
+  c.Specify("Reserved values are reported", func() {
+    err := headerError(id, comment, withSetup(func(s *syntheticSetup) {
+      s.floors[0] = func(w *bitWriter) {
+        w.Write(2, 16)
+      }
+    }))
+    c.Assume(err != nil, IsTrue)
+    c.Expect(err.Err, Equals, vorbis.ErrReserved)
+  })
+
+  c.Specify("Truncated setup headers give an error rather than a panic", func() {
+    for n := 7; n < len(setup); n++ {
+      _, err := vorbis.NewDecoder(bytes.NewReader(oggStream(id, comment, setup[0:n])))
+      c.Expect(err, Not(Equals), nil)
+    }
+  })
+}
+
+func LimitsSpec(c gospec.Context) {
+  id, setup, _, _ := syntheticSpectrumStream(2, nil, []bool{true, true})
+  comment := syntheticCommentHeader("vendor", "TITLE=test")
+
+  // limitError makes a decoder from the given headers and returns the
+  // LimitError it fails with, or nil if it doesn't fail with one.
+  limitError := func(limits ogg.Limits, id, comment, setup []byte) *ogg.LimitError {
+    data := oggStream(id, comment, setup)
+    _, err := vorbis.NewDecoderWithOptions(bytes.NewReader(data), ogg.Options{Limits: limits})
+    c.Expect(errors.Is(err, ogg.ErrLimitExceeded), Equals, err != nil)
+    var limit_err *ogg.LimitError
+    if !errors.As(err, &limit_err) {
+      return nil
+    }
+    return limit_err
+  }
+
+  c.Specify("The default limits allow ordinary streams", func() {
+    c.Expect(limitError(ogg.Limits{}, id, comment, setup) == nil, IsTrue)
+  })
+
+  c.Specify("Too many channels are reported", func() {
+    err := limitError(ogg.Limits{Max_channels: 1}, id, comment, setup)
+    c.Assume(err != nil, IsTrue)
+    c.Expect(err.Limit, Equals, "Max_channels")
+    c.Expect(err.Value, Equals, int64(2))
+    c.Expect(limitError(ogg.Limits{Max_channels: 2}, id, comment, setup) == nil, IsTrue)
+  })
+
+  c.Specify("Too many bytes of comments are reported", func() {
+    // The vendor string, a length and the comment
+    err := limitError(ogg.Limits{Max_comment_bytes: 19}, id, comment, setup)
+    c.Assume(err != nil, IsTrue)
+    c.Expect(err.Limit, Equals, "Max_comment_bytes")
+    c.Expect(err.Value, Equals, int64(20))
+    c.Expect(limitError(ogg.Limits{Max_comment_bytes: 20}, id, comment, setup) == nil, IsTrue)
+  })
+
+  c.Specify("Setup headers that need too much memory are reported", func() {
+    err := limitError(ogg.Limits{Max_setup_memory: 100}, id, comment, setup)
+    c.Assume(err != nil, IsTrue)
+    c.Expect(err.Limit, Equals, "Max_setup_memory")
+    c.Expect(err.Max, Equals, int64(100))
+  })
+
+  c.Specify("A tiny codebook can't ask for millions of entries", func() {
+    huge := hugeCodebookSetup()
+    c.Expect(len(huge) < 24, IsTrue)
+
+    err := limitError(ogg.Limits{}, id, comment, huge)
+    c.Assume(err != nil, IsTrue)
+    c.Expect(err.Limit, Equals, "Max_codebook_entries")
+    c.Expect(err.Value, Equals, int64(0xffffff))
+    _, header_err := vorbis.NewDecoder(bytes.NewReader(oggStream(id, comment, huge)))
+    c.Expect(header_err.Error(), Equals, "Invalid setup header, codebook 0 entries: Over Max_codebook_entries of 1048576 with 16777215.")
+  })
 }
@@ -0,0 +1,170 @@
+package ogg
+
+import (
+  "bytes"
+  "encoding/binary"
+  "io"
+)
+
+// NoGranulePosition is the granule position of a page on which no packet
+// ends.
+const NoGranulePosition = ^uint64(0)
+
+// Writers start a new page once this much data is waiting, unless
+// Page_size is set.
+const default_page_size = 4096
+
+// A Writer packs the packets of a single logical bitstream into pages.
+// Packets are buffered until there is enough data for a page, or until Flush
+// or Close is called.
+type Writer struct {
+  out    io.Writer
+  serial uint32
+
+  // Once a page holds at least this many bytes of packet data it is written
+  // out, if it is zero default_page_size is used.  A page also ends when it
+  // runs out of lacing values, so no page holds more than 255*255 bytes.
+  Page_size int
+
+  sequence uint32
+  bos      bool
+  eos      bool
+
+  // Lacing values and data that haven't been written to a page yet.  The
+  // granule position of each packet is stored with its last lacing value,
+  // other lacing values have NoGranulePosition.
+  segments  []uint8
+  granules  []uint64
+  data      []byte
+  continued bool
+}
+
+func NewWriter(out io.Writer, serial uint32) *Writer {
+  return &Writer{out: out, serial: serial, bos: true}
+}
+
+// WritePacket adds a packet to the stream, its granule position is the one
+// the codec gives to the end of the packet.  Pages are written out as they
+// fill up.
+func (w *Writer) WritePacket(data []byte, granule_position uint64) error {
+  if w.eos {
+    return io.ErrClosedPipe
+  }
+  w.data = append(w.data, data...)
+  for {
+    seg_len := len(data)
+    if seg_len > 255 {
+      seg_len = 255
+    }
+    w.segments = append(w.segments, uint8(seg_len))
+    w.granules = append(w.granules, NoGranulePosition)
+    data = data[seg_len:]
+    if seg_len < 255 {
+      break
+    }
+  }
+  w.granules[len(w.granules)-1] = granule_position
+
+  for w.pageReady() {
+    if err := w.writePage(false); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// pageReady returns true if there is enough pending data for a full page
+func (w *Writer) pageReady() bool {
+  page_size := w.Page_size
+  if page_size <= 0 {
+    page_size = default_page_size
+  }
+  return len(w.segments) >= 255 || len(w.data) >= page_size
+}
+
+// Flush writes out everything that has been written so far, so that the next
+// packet starts on a new page.  Codecs use this to put their headers on pages
+// of their own.
+func (w *Writer) Flush() error {
+  for len(w.segments) > 0 {
+    if err := w.writePage(false); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// Close writes out everything that is left and marks the last page as the end
+// of the bitstream.  If there's nothing left an empty page is written.
+func (w *Writer) Close() error {
+  if w.eos {
+    return nil
+  }
+  for w.pageReady() {
+    if err := w.writePage(false); err != nil {
+      return err
+    }
+  }
+  return w.writePage(true)
+}
+
+// writePage writes a page with as many of the pending segments as fit
+func (w *Writer) writePage(eos bool) error {
+  page_size := w.Page_size
+  if page_size <= 0 {
+    page_size = default_page_size
+  }
+  num_segments := 0
+  num_bytes := 0
+  granule := NoGranulePosition
+  for num_segments < len(w.segments) && num_segments < 255 && num_bytes < page_size {
+    num_bytes += int(w.segments[num_segments])
+    if w.granules[num_segments] != NoGranulePosition {
+      granule = w.granules[num_segments]
+    }
+    num_segments++
+  }
+
+  var page Page
+  copy(page.Capture_pattern[:], "OggS")
+  if w.continued {
+    page.Header_type |= 0x1
+  }
+  if w.bos {
+    page.Header_type |= 0x2
+  }
+  if eos {
+    page.Header_type |= 0x4
+  }
+  page.Granule_position = granule
+  page.Bitstream_serial_number = w.serial
+  page.Page_sequence_number = w.sequence
+  page.Page_segments = uint8(num_segments)
+  page.Segment_table = w.segments[0:num_segments]
+  page.Data = w.data[0:num_bytes]
+
+  var crc oggCRC
+  binary.Write(&crc, binary.LittleEndian, &page.HeaderFixed)
+  crc.Write(page.Segment_table)
+  crc.Write(page.Data)
+  page.Crc_checksum = uint32(crc)
+
+  buffer := bytes.NewBuffer(nil)
+  binary.Write(buffer, binary.LittleEndian, &page.HeaderFixed)
+  buffer.Write(page.Segment_table)
+  buffer.Write(page.Data)
+  if _, err := w.out.Write(buffer.Bytes()); err != nil {
+    return err
+  }
+
+  if num_segments > 0 {
+    w.continued = w.segments[num_segments-1] == 255
+  }
+  w.segments = w.segments[num_segments:]
+  w.granules = w.granules[num_segments:]
+  w.data = w.data[num_bytes:]
+  w.sequence++
+  w.bos = false
+  w.eos = eos
+  return nil
+}